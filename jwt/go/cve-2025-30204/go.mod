@@ -3,6 +3,7 @@ module github.com/cyber-sec-itmo/playground/jwt/go/cve-2025-30204
 go 1.25.5
 
 require (
+	github.com/go-jose/go-jose/v4 v4.1.4
 	github.com/google/uuid v1.6.0
 	github.com/mattn/go-sqlite3 v1.14.32
 )
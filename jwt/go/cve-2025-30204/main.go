@@ -2,44 +2,76 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
+	"math"
+	"math/bits"
+	mathrand "math/rand/v2"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	jose "github.com/go-jose/go-jose/v4"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
-	_ "github.com/mattn/go-sqlite3"
-	_ "net/http/pprof"
+	"github.com/mattn/go-sqlite3"
 )
 
 // Start1HzCSV starts a low-allocation sampler writing 1 line/second CSV.
 // It never blocks request handling except for minimal file I/O.
 // Call cancel to stop. Intended for lab load tests.
+// The file is appended to, not truncated: after a graceful restart the old process
+// is still writing it while it drains. Every line goes out in a single write.
 func Start1HzCSV(ctx context.Context, path string) (stop func(), err error) {
-	f, err := os.Create(path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
 	if err != nil {
 		return nil, err
 	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
 	// Big buffer: reduce syscalls; keep overhead stable.
 	w := bufio.NewWriterSize(f, 1<<20)
 
-	// Header
-	_, _ = w.WriteString("ts_unix,heap_alloc,heap_inuse,heap_sys,heap_objects,next_gc,num_gc,pause_total_ns,gc_cpu_fraction,goroutines,rss_bytes,open_fds,threads\n")
+	// Header, once per file
+	if info.Size() == 0 {
+		_, _ = w.WriteString("ts_unix,heap_alloc,heap_inuse,heap_sys,heap_objects,next_gc,num_gc,pause_total_ns,gc_cpu_fraction,goroutines,rss_bytes,open_fds,threads\n")
+	}
 	_ = w.Flush()
 
 	var stopped int32
@@ -210,909 +242,7805 @@ func readThreads() int {
 }
 
 const (
+	ServiceName = "jwtgo"
+
 	DefaultDatabaseSqliteURI = "jwtgo.sqlite"
 
 	DefaultServerAddr = "localhost"
 	DefaultServerPort = "8080"
 
 	DefaultJWTSecret = "00000000-0000-0000-1000-000000000000"
+
+	// typ header of issued tokens, JWT_TYP=at+jwt for RFC 9068 access tokens
+	DefaultJWTTyp = "JWT"
+
+	// Tolerated clock skew between issuer and verifier for exp/nbf/iat checks
+	DefaultJWTClockSkew = 0 * time.Second
+
+	// Clock drift against NTP_CHECK_SERVER that is reported, and how often it is measured
+	DefaultNTPMaxDrift      = time.Second
+	DefaultNTPCheckInterval = time.Hour
+
+	// Caps on client-supplied custom claims, counted and measured as serialized JSON
+	DefaultMaxCustomClaims      = 16
+	DefaultMaxCustomClaimsBytes = 1024
+
+	// Largest token /tokens/auth hands out, below the common 8 KiB proxy header limit
+	DefaultMaxTokenBytes = 4096
+
+	// Lifetime of verify cache entries, bounds how long a revocation elsewhere goes unnoticed
+	DefaultVerifyCacheTTL = 5 * time.Second
+
+	// Hard ceiling on token lifetime regardless of the requested expires_sec, 0 disables it
+	DefaultMaxExpiry = 365 * 24 * time.Hour
+
+	// How long an issued proof-of-work challenge can be solved and submitted
+	DefaultPowChallengeTTL = 5 * time.Minute
+
+	// How long tokens signed with JWT_PREVIOUS_SECRET are accepted after rotation
+	DefaultJWTRotationGrace = 24 * time.Hour
+
+	// Size of the read-only connection pool, 1 disables the separate pool
+	DefaultDatabaseReadConns = 4
+
+	// Consecutive database failures that open the circuit breaker, and how long it stays open
+	DefaultDBBreakerThreshold = 5
+	DefaultDBBreakerCooldown  = 10 * time.Second
+
+	// Rolling window of the per-subject issuance report on the admin listener
+	DefaultIssuanceWindow = time.Hour
+
+	// Span of the issuance histogram on the admin listener
+	DefaultIssuanceHistory = 7 * 24 * time.Hour
+
+	// Upper bound for a single VACUUM run
+	DefaultVacuumTimeout = 5 * time.Minute
+
+	// How often nonces of expired one-time tokens are deleted
+	DefaultNonceCleanupInterval = 10 * time.Minute
+
+	// How often DPoP proof jtis past their replay window are forgotten
+	DefaultDPoPPruneInterval = time.Minute
+
+	// How often expired proof-of-work challenges are forgotten
+	DefaultPowPruneInterval = time.Minute
+
+	// Upper bound for one CLAIMS_TRANSFORMER_CMD run, signup fails past it
+	DefaultClaimsTransformerTimeout = 2 * time.Second
+	// How long output of a killed CLAIMS_TRANSFORMER_CMD is waited for, a process it started may hold the pipes
+	DefaultClaimsTransformerWaitDelay = 100 * time.Millisecond
+
+	// How often per-client issuance counts are written to client_usage with CLIENT_ACCOUNTING
+	DefaultUsageFlushInterval = 5 * time.Second
+
+	// Retry-After of requests refused in MAINTENANCE_MODE
+	DefaultMaintenanceRetryAfter = 5 * time.Minute
+
+	// How often the token count compared against MAX_TOTAL_TOKENS is refreshed,
+	// and the least time between two purges of expired tokens at the cap
+	DefaultTokenCountInterval = 30 * time.Second
+
+	// How long startup retries a database file locked by another process
+	DefaultDatabaseLockWait = 30 * time.Second
+
+	// Free disk space below which /healthz reports the database as degraded
+	DefaultHealthMinFreeDiskBytes = 64 << 20
+
+	// How long a new connection may take to send its PROXY protocol header
+	DefaultProxyHeaderTimeout = 5 * time.Second
 )
 
-// --- DATA STRUCTURE ---
+// Deployment environments accepted by APP_ENV, production turns security warnings into startup errors
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
 
-// Token represents a JWT token
-type Token struct {
-	ID        string    `json:"id"` // jti (UUID)
-	IsRevoked bool      `json:"is_revoked"`
-	IssuedAt  time.Time `json:"issued_at"`
-	ExpiresAt time.Time `json:"expires_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	ClientIP  string    `json:"client_ip"`
-	UserAgent string    `json:"user_agent"`
+// Log levels accepted by LOG_LEVEL
+const (
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
+)
 
-	// Optional audit fields:
-	Token string `json:"token,omitempty"` // jwt full token string
-}
+// Issued token formats accepted by TOKEN_FORMAT
+const (
+	TokenFormatJWT    = "jwt"
+	TokenFormatPaseto = "paseto" // PASETO v4.public, signed with PASETO_SECRET_KEY
+)
 
-// TokenUsage represents a single usage event for a token
-type TokenUsage struct {
-	ID        int64     `json:"id"`
-	TokenID   string    `json:"token_id"`
-	TS        time.Time `json:"ts"`
-	ClientIP  string    `json:"client_ip"`
-	UserAgent string    `json:"user_agent"`
-	Method    string    `json:"method"`
-	Status    int       `json:"status"`
-}
+// Token profiles accepted by OAUTH_PROFILE
+const (
+	OAuthProfileRFC9068 = "rfc9068" // JWT Profile for OAuth 2.0 Access Tokens
+)
 
-// --- DATABASE ---
+// Error body detail levels accepted by ERROR_DETAIL
+const (
+	ErrorDetailFull    = "full"    // 500 responses carry the underlying error
+	ErrorDetailMinimal = "minimal" // 500 responses carry only a reference to the log line
+)
 
-// SqliteDB represents a SQLite database connection
-type SqliteDB struct {
-	db *sql.DB
+// Policies applied when a requested expiry exceeds ABSOLUTE_MAX_EXPIRY_SEC
+const (
+	MaxExpiryPolicyClamp  = "clamp"
+	MaxExpiryPolicyReject = "reject"
+)
+
+// SameSite modes accepted by COOKIE_SAMESITE
+const (
+	CookieSameSiteLax    = "lax"
+	CookieSameSiteStrict = "strict"
+	CookieSameSiteNone   = "none"
+)
+
+// Health statuses reported by /healthz
+const (
+	HealthStatusOK        = "ok"
+	HealthStatusDegraded  = "degraded"
+	HealthStatusUnhealthy = "unhealthy"
+)
+
+// --- CONFIG ---
+
+// Config holds application configuration loaded from environment variables.
+// Values from the optional CONFIG_FILE (KEY=VALUE lines) override the environment,
+// so editing the file and sending SIGHUP reloads them.
+// Only the JWT settings are reloadable, the rest require a restart.
+type Config struct {
+	Env                 string
+	DatabaseURI         string
+	DatabaseReadConns   int
+	DatabaseLockWait    time.Duration // how long startup waits for another process to release the file
+	DatabaseAutoMigrate bool
+	ClaimColumns        []string // claims copied into indexed claim_<name> columns of tokens
+	RowHMACKey          []byte   // key of the per-row tokens signature, nil disables integrity checks
+	DBBreakerThreshold  int      // 0 disables the breaker
+	DBBreakerCooldown   time.Duration
+	ServerAddr          string
+	ServerPort          string
+	MaxConcurrent       int // in-flight request cap, 0 is unlimited
+	VerifyCacheSize     int // jti entries cached by lookupActiveToken, 0 disables the cache
+	VerifyCacheTTL      time.Duration
+	H2C                 bool          // cleartext HTTP/2, for deployments where a proxy terminates TLS
+	ProxyProtocol       bool          // connections start with a PROXY protocol header carrying the client address
+	ListenBacklog       int           // accept queue length of the public listener, 0 keeps the system default
+	TCPKeepAlive        time.Duration // keep-alive probe interval on accepted connections, 0 keeps Go's 15s, negative disables
+	HTTPKeepAlives      bool          // reuse connections for further requests, disable to close after each response
+	SelfTest            bool          // mint and verify a token at startup, exit if that fails
+
+	// Reloadable
+	LogLevel                 string
+	LogSampleRate            float64 // fraction of successful requests logged, errors are always logged
+	JWTAlg                   string  // HMAC algorithm tokens are signed with
+	JWTTyp                   string  // typ header of issued tokens
+	JWTCty                   string  // cty header of issued tokens, omitted when empty
+	VerifyExpectedTyp        string  // typ header verification requires, any when empty
+	OAuthProfile             string  // OAuthProfileRFC9068 or empty
+	SubjectAuthToken         []byte  // front end credential for signups naming a subject, nil refuses subjects
+	OAuthIssuer              string  // iss of tokens signed with the default key, required by the profile
+	OAuthAudience            string  // aud of issued tokens, required by the profile
+	JWTSecret                SecretProvider
+	JWTEncryptionKey         []byte             // 32-byte A256GCM key, nil unless JWT_ENCRYPT=1
+	TokenFormat              string             // TokenFormatJWT or TokenFormatPaseto, the format of issued tokens
+	PasetoKey                ed25519.PrivateKey // v4.public signing key, PASETO tokens are accepted whenever it is set
+	JWTPreviousSecret        []byte
+	JWTSecretRotatedAt       time.Time     // when the current secret was introduced, zero if unknown
+	JWTSecretMaxAge          time.Duration // rotation deadline after JWTSecretRotatedAt, 0 disables
+	JWTRotationGrace         time.Duration
+	Tenants                  map[string]Tenant // by name, which tenant tokens carry as kid
+	ClockSkew                time.Duration
+	RequiredTimeClaims       []string      // of exp, nbf, iat, tokens lacking one are rejected (REQUIRE_EXP, ...)
+	NTPCheckServer           string        // host[:port] queried for clock drift, empty disables the check
+	NTPMaxDrift              time.Duration // drift beyond this is logged and degrades /healthz
+	VerifyExplain            bool
+	ErrorDetail              string   // ErrorDetailFull or ErrorDetailMinimal, minimal by default in production
+	DPoPEnabled              bool     // signup requires a DPoP proof and binds the token to its key (RFC 9449)
+	PublicURL                *url.URL // origin clients address, DPoP proofs' htu is checked against it; nil uses the request's
+	OneTimeTokens            bool     // signup adds a nonce claim, tokens with a nonce verify only once
+	UniqueNamedTokens        bool     // signup revokes the subject's active tokens with the same name
+	VerifyAllowedAlgs        []string // alg header values accepted by /tokens/validate and friends
+	BlockedSubjects          map[string]bool
+	AllowedSubjects          map[string]bool // nil allows any subject, otherwise anonymous tokens are refused too
+	MaxExpiry                time.Duration
+	MaxExpiryPolicy          string
+	PowDifficulty            int // leading zero bits required from /tokens/auth clients, 0 disables
+	MaxCustomClaims          int // 0 disables custom claims
+	MaxCustomClaimsBytes     int
+	MaxTokenBytes            int           // signed (and encrypted) token length cap, 0 disables
+	MaxTotalTokens           int64         // token rows kept in the database, signup fails past it, 0 disables
+	IdleTimeout              time.Duration // tokens unused for longer are rejected and later revoked, 0 disables
+	MaintenanceMode          bool          // mutating endpoints answer 503, reads keep working
+	MaintenanceRetryAfter    time.Duration // Retry-After sent with maintenance 503s
+	SlidingMaxLifetime       time.Duration // absolute lifetime of sliding tokens, 0 disables sliding expiration
+	ClaimsTransformerCmd     []string      // command run on each token's claims before signing, empty for none
+	ClaimsTransformerTimeout time.Duration
+	RootInfo                 bool
+	RequestTimeout           time.Duration            // 0, the default, disables
+	RouteTimeouts            map[string]time.Duration // by exact URL path, 0 disables
+
+	// ALLOW_QUERY_TOKEN=1 lets /tokens/validate read the token from ?access_token= for EventSource and
+	// WebSocket clients, which cannot set headers. URLs end up in proxy logs, browser history and
+	// Referer headers, so it is off by default; the access log here always redacts the parameter.
+	AllowQueryToken bool
+
+	// Cookie carrying the token next to the JSON body, disabled when CookieName is empty
+	CookieName     string
+	CookieSameSite http.SameSite
+	CookieSecure   bool
+	CookieDomain   string
+	CookiePath     string
+
+	// Browser origins allowed to call the API cross-origin ("*" for any), CORS is off when empty.
+	// With CORSAllowCredentials the cookie and Authorization header are sent cross-origin too.
+	CORSAllowedOrigins   map[string]bool
+	CORSAllowCredentials bool
+
+	// Headers set on every public response, by canonical name. Strict-Transport-Security is only
+	// sent on requests that arrived over TLS, here or at the proxy (X-Forwarded-Proto: https).
+	SecurityHeaders map[string]string
+
+	// Admin listener for net/http/pprof and /admin/vacuum, disabled when empty. Never served on the public mux.
+	PprofAddr string
+
+	// ADMIN_TOKEN, the bearer token every admin listener request must carry
+	AdminToken []byte
+
+	// Routes left out of the muxes, by pattern (see endpointPatterns); they fall through to 404
+	DisabledEndpoints map[string]bool
+
+	// Default window of /admin/issuance, overridable per request with ?window_sec=
+	IssuanceWindow time.Duration
+
+	// Default span of /admin/issuance/histogram, overridable per request with ?history_sec=
+	IssuanceHistory time.Duration
+
+	// Audit log destination: "stdout", "stderr" or a file path, disabled when empty
+	AuditLogOutput string
+
+	// CLIENT_ACCOUNTING=1 counts issued tokens per client_id claim for /admin/usage.
+	// Only signups presenting SUBJECT_AUTH_TOKEN are counted, anyone else can name any client.
+	ClientAccounting bool
+
+	// Scheduled VACUUM, disabled when VacuumInterval is 0.
+	// Runs only while the local hour is in [VacuumWindowStart, VacuumWindowEnd),
+	// POST /admin/vacuum too unless forced.
+	VacuumInterval    time.Duration
+	VacuumWindowStart int
+	VacuumWindowEnd   int
+
+	// Directory /admin/backup writes its temporary copy to, os.TempDir() when empty
+	BackupDir string
 }
 
-// NewSqliteDB creates a new SQLite database connection with specified options
-func NewSqliteDB(uri string, enableWal bool, syncPragma string) (*SqliteDB, error) {
-	params := url.Values{}
-	params.Add("_synchronous", "NORMAL")
-	params.Add("_journal_mode", "WAL")
+// endpointPatterns are the routes ENABLED_ENDPOINTS and DISABLED_ENDPOINTS can name, public and admin.
+// Keep in sync with the registrations in main.
+var endpointPatterns = []string{
+	"/{$}", "/ping", "/healthz", "/version",
+	"/tokens", "/tokens/auth", "/tokens/auth/challenge", "/tokens/validate", "/tokens/validate/batch", "/tokens/validate_unverified",
+	"/tokens/usage", "/tokens/revoke", "/tokens/sessions", "/tokens/ttl", "/tokens/reissue", "/tokens/export", "/tokens/export/verify",
+	"/tokens/{id}", "/revocations",
+	"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/profile", "/debug/pprof/symbol", "/debug/pprof/trace",
+	"/admin/vacuum", "/admin/issuance", "/admin/issuance/histogram", "/admin/integrity", "/admin/revoke", "/admin/backup",
+	"/admin/usage",
+}
 
-	constructedUri := uri
-	if len(params) > 0 {
-		if strings.Contains(uri, "?") {
-			constructedUri += "&" + params.Encode()
-		} else {
-			constructedUri += "?" + params.Encode()
+// defaultSecurityHeaders are the baseline hardening headers, overridable with SECURITY_HEADERS.
+// Responses are JSON or plain text, nothing to frame or to leak a Referer from.
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "DENY",
+	"Referrer-Policy":           "no-referrer",
+	"Strict-Transport-Security": "max-age=31536000",
+}
+
+// parseEndpointList splits a comma-separated list of endpoint patterns, rejecting unknown ones
+func parseEndpointList(name, list string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if !slices.Contains(endpointPatterns, pattern) {
+			return nil, fmt.Errorf("invalid %s: unknown endpoint %q", name, pattern)
 		}
+		set[pattern] = true
 	}
+	return set, nil
+}
 
-	db, err := sql.Open("sqlite3", constructedUri)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database with DSN '%s': %w", constructedUri, err)
+// parseSubjectSet splits a comma-separated subject list, returning nil when it is empty
+func parseSubjectSet(list string) map[string]bool {
+	var set map[string]bool
+	for _, subject := range strings.Split(list, ",") {
+		if subject = strings.TrimSpace(subject); subject != "" {
+			if set == nil {
+				set = map[string]bool{}
+			}
+			set[subject] = true
+		}
 	}
+	return set
+}
 
-	// Configure connection pool settings
-	db.SetMaxOpenConns(1) // SQLite only supports one writer at a time
-	db.SetMaxIdleConns(1)
-	db.SetConnMaxLifetime(time.Hour)
+// subjectAuthenticated reports whether the request carries SUBJECT_AUTH_TOKEN as its bearer token
+func subjectAuthenticated(r *http.Request, cfg *Config) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && cfg.SubjectAuthToken != nil && hmac.Equal([]byte(token), cfg.SubjectAuthToken)
+}
 
-	// Enable foreign key support for this connection.
-	// This is crucial for ON DELETE CASCADE and other FK actions to work.
-	_, err = db.Exec("PRAGMA foreign_keys = ON;")
-	if err != nil {
-		db.Close() // Close DB if we can't set the pragma
-		return nil, fmt.Errorf("failed to enable foreign key support for DSN '%s': %w", constructedUri, err)
+// subjectPermitted checks a token subject ("" for anonymous) against BLOCKED_SUBJECTS and ALLOWED_SUBJECTS
+func (c *Config) subjectPermitted(subject string) bool {
+	if c.BlockedSubjects[subject] {
+		return false
 	}
-
-	return &SqliteDB{db: db}, nil
+	return c.AllowedSubjects == nil || c.AllowedSubjects[subject]
 }
 
-// RunMigrations applies migrations to the database
-func (s *SqliteDB) RunMigrations(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
-	m1 := `CREATE TABLE IF NOT EXISTS tokens (
-		id          TEXT PRIMARY KEY,
-		is_revoked  INTEGER NOT NULL,
-		issued_at   TEXT NOT NULL,
-		expires_at  TEXT NOT NULL,
-		updated_at  TEXT NOT NULL,
-		client_ip   TEXT,
-		user_agent 	TEXT
-	);`
+// signingKeyStats computes the signing secret's age and rotation countdown at now
+func signingKeyStats(cfg *Config, now time.Time) SigningKeyStats {
+	stats := SigningKeyStats{VerificationKeys: 1 + len(cfg.Tenants)}
+	if cfg.previousSecretValid(now) {
+		stats.VerificationKeys++
+	}
+	if !cfg.JWTSecretRotatedAt.IsZero() {
+		age := int64(now.Sub(cfg.JWTSecretRotatedAt).Seconds())
+		stats.AgeSec = &age
+	}
+	if cfg.JWTSecretMaxAge > 0 {
+		days := cfg.JWTSecretRotatedAt.Add(cfg.JWTSecretMaxAge).Sub(now).Hours() / 24
+		stats.DaysUntilRotation = &days
+	}
+	return stats
+}
 
-	m2 := `CREATE TABLE IF NOT EXISTS token_usages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		token_id TEXT NOT NULL,
-		ts INTEGER NOT NULL,
-		client_ip   TEXT,
-		user_agent 	TEXT,
-		method TEXT,
-		status INTEGER,
-		FOREIGN KEY (token_id) REFERENCES tokens(id) ON DELETE CASCADE
-	);
-	CREATE INDEX IF NOT EXISTS idx_usage_token_ts ON token_usages(token_id, ts);`
+// rfc9068Claims must be present in every access token, RFC 9068 section 2.2
+var rfc9068Claims = []string{"iss", "exp", "aud", "sub", "client_id", "iat", "jti"}
 
-	// Run migrations sequentially
-	if _, err := s.db.ExecContext(ctx, m1); err != nil {
-		return fmt.Errorf("failed to run migration m1: %w", err)
+// checkRFC9068Claims enforces the access token profile beyond typ: the required claims are there,
+// iss is ours (tenant tokens are checked against their tenant by parseJWTToken) and aud includes us
+func checkRFC9068Claims(claims jwt.MapClaims, cfg *Config) error {
+	for _, name := range rfc9068Claims {
+		if _, ok := claims[name]; !ok {
+			return fmt.Errorf("%w: missing %s", ErrTokenProfile, name)
+		}
 	}
-
-	if _, err := s.db.ExecContext(ctx, m2); err != nil {
-		return fmt.Errorf("failed to run migration m2: %w", err)
+	if iss, _ := claims["iss"].(string); iss != cfg.OAuthIssuer && !isTenantIssuer(cfg, iss) {
+		return fmt.Errorf("%w: unknown iss", ErrTokenProfile)
+	}
+	if !claims.VerifyAudience(cfg.OAuthAudience, true) {
+		return fmt.Errorf("%w: aud does not include %s", ErrTokenProfile, cfg.OAuthAudience)
 	}
-
 	return nil
 }
 
-// TestConnection tests the database connection with a timeout
-func (s *SqliteDB) TestConnection(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
+// isTenantIssuer reports whether iss is the issuer of one of the JWT_TENANTS
+func isTenantIssuer(cfg *Config, iss string) bool {
+	for _, tenant := range cfg.Tenants {
+		if tenant.Issuer == iss {
+			return true
+		}
+	}
+	return false
+}
 
-	return s.db.PingContext(ctx)
+// normalizeTyp compares typ values the way RFC 7515 section 4.1.9 asks:
+// case-insensitively, with the "application/" prefix optional
+func normalizeTyp(typ string) string {
+	typ = strings.ToLower(typ)
+	return strings.TrimPrefix(typ, "application/")
 }
 
-// Close closes the database connection
-func (s *SqliteDB) Close() error {
-	if s.db != nil {
-		return s.db.Close()
-	}
-	return nil
+// previousSecretValid reports whether the previous secret is still within its rotation grace window
+func (c *Config) previousSecretValid(now time.Time) bool {
+	return len(c.JWTPreviousSecret) > 0 && now.Before(c.JWTSecretRotatedAt.Add(c.JWTRotationGrace))
 }
 
-// parseTokenFromDb fills a Token struct from database row values
-func parseTokenFromDb(token *Token, isRevokedInt int, issuedAtStr, expiresAtStr, updatedAtStr string, clientIP, userAgent sql.NullString) error {
-	// Convert INTEGER to boolean
-	token.IsRevoked = isRevokedInt != 0
+// inVacuumWindow reports whether the local hour of now is within VACUUM_WINDOW
+func (c *Config) inVacuumWindow(now time.Time) bool {
+	h := now.Hour()
+	return h >= c.VacuumWindowStart && h < c.VacuumWindowEnd
+}
 
-	// Parse Unix timestamps to time.Time
-	issuedAtUnix, err := strconv.ParseInt(issuedAtStr, 10, 64)
+// readConfigFile parses KEY=VALUE lines, skipping blanks and # comments
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to parse issued_at: %w", err)
+		return nil, err
 	}
-	token.IssuedAt = time.Unix(issuedAtUnix, 0)
 
-	expiresAtUnix, err := strconv.ParseInt(expiresAtStr, 10, 64)
-	if err != nil {
-		return fmt.Errorf("failed to parse expires_at: %w", err)
+	values := map[string]string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
 	}
-	token.ExpiresAt = time.Unix(expiresAtUnix, 0)
+	return values, nil
+}
 
-	updatedAtUnix, err := strconv.ParseInt(updatedAtStr, 10, 64)
-	if err != nil {
-		return fmt.Errorf("failed to parse updated_at: %w", err)
+// LoadConfig reads configuration from environment variables and CONFIG_FILE, falling back to defaults
+func LoadConfig() (*Config, error) {
+	fileValues := map[string]string{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CONFIG_FILE: %w", err)
+		}
+		fileValues = values
+	}
+	getenv := func(key string) string {
+		if v, ok := fileValues[key]; ok {
+			return v
+		}
+		return os.Getenv(key)
 	}
-	token.UpdatedAt = time.Unix(updatedAtUnix, 0)
 
-	// Set client_ip and user_agent
-	token.ClientIP = clientIP.String
-	token.UserAgent = userAgent.String
+	cfg := &Config{
+		Env:                      EnvDevelopment,
+		DatabaseURI:              getenv("DATABASE_URI"),
+		DatabaseReadConns:        DefaultDatabaseReadConns,
+		DatabaseLockWait:         DefaultDatabaseLockWait,
+		ClaimsTransformerTimeout: DefaultClaimsTransformerTimeout,
+		DBBreakerThreshold:       DefaultDBBreakerThreshold,
+		DBBreakerCooldown:        DefaultDBBreakerCooldown,
+		VerifyCacheTTL:           DefaultVerifyCacheTTL,
+		DatabaseAutoMigrate:      getenv("DATABASE_AUTO_MIGRATE") != "0", // migrations run on startup unless disabled
+		ServerAddr:               getenv("SERVER_ADDR"),
+		ServerPort:               getenv("SERVER_PORT"),
+		H2C:                      getenv("H2C") == "1",
+		ProxyProtocol:            getenv("PROXY_PROTOCOL") == "1",
+		HTTPKeepAlives:           getenv("HTTP_KEEPALIVES") != "0",
+		JWTRotationGrace:         DefaultJWTRotationGrace,
+		ClockSkew:                DefaultJWTClockSkew,
+		NTPMaxDrift:              DefaultNTPMaxDrift,
+		MaxExpiry:                DefaultMaxExpiry,
+		MaxExpiryPolicy:          MaxExpiryPolicyClamp,
+		LogSampleRate:            1,
+		LogLevel:                 LogLevelInfo,
+		MaxCustomClaims:          DefaultMaxCustomClaims,
+		MaxCustomClaimsBytes:     DefaultMaxCustomClaimsBytes,
+		MaxTokenBytes:            DefaultMaxTokenBytes,
+		JWTAlg:                   jwt.SigningMethodHS256.Alg(),
+		RouteTimeouts:            map[string]time.Duration{},
+		PprofAddr:                getenv("PPROF_ADDR"),
+		AuditLogOutput:           getenv("AUDIT_LOG_OUTPUT"),
+		ClientAccounting:         getenv("CLIENT_ACCOUNTING") == "1",
+		IssuanceWindow:           DefaultIssuanceWindow,
+		IssuanceHistory:          DefaultIssuanceHistory,
+		MaintenanceMode:          getenv("MAINTENANCE_MODE") == "1",
+		MaintenanceRetryAfter:    DefaultMaintenanceRetryAfter,
+		AllowQueryToken:          getenv("ALLOW_QUERY_TOKEN") == "1",
+		CookieName:               getenv("COOKIE_NAME"),
+		CookieSameSite:           http.SameSiteLaxMode,
+		CookieSecure:             getenv("COOKIE_SECURE") == "1",
+		CookieDomain:             getenv("COOKIE_DOMAIN"),
+		CookiePath:               getenv("COOKIE_PATH"),
+	}
 
-	return nil
-}
+	switch sameSite := strings.ToLower(getenv("COOKIE_SAMESITE")); sameSite {
+	case "", CookieSameSiteLax:
+	case CookieSameSiteStrict:
+		cfg.CookieSameSite = http.SameSiteStrictMode
+	case CookieSameSiteNone:
+		// Browsers drop SameSite=None cookies without Secure
+		if !cfg.CookieSecure {
+			return nil, fmt.Errorf("invalid COOKIE_SAMESITE: %s requires COOKIE_SECURE=1", sameSite)
+		}
+		cfg.CookieSameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("invalid COOKIE_SAMESITE: %s, must be %q, %q or %q", sameSite, CookieSameSiteLax, CookieSameSiteStrict, CookieSameSiteNone)
+	}
 
-func (s *SqliteDB) ListTokens(ctx context.Context) ([]Token, error) {
-	query := "SELECT id, is_revoked, issued_at, expires_at, updated_at, client_ip, user_agent FROM tokens ORDER BY updated_at"
+	// CORS_ALLOWED_ORIGINS=https://app.example.com,https://admin.example.com. Credentialed requests
+	// (CORS_ALLOW_CREDENTIALS=1, e.g. for the token cookie) need the exact origin echoed, the
+	// Fetch standard forbids a wildcard with credentials, so "*" is refused in that mode.
+	cfg.CORSAllowedOrigins = parseSubjectSet(getenv("CORS_ALLOWED_ORIGINS"))
+	cfg.CORSAllowCredentials = getenv("CORS_ALLOW_CREDENTIALS") == "1"
+	if cfg.CORSAllowCredentials {
+		if len(cfg.CORSAllowedOrigins) == 0 || cfg.CORSAllowedOrigins["*"] {
+			return nil, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS: %q, CORS_ALLOW_CREDENTIALS=1 requires explicit origins, not *", getenv("CORS_ALLOWED_ORIGINS"))
+		}
+	}
 
-	rows, err := s.db.QueryContext(ctx, query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query tokens: %w", err)
+	// SECURITY_HEADERS=X-Frame-Options=SAMEORIGIN,Strict-Transport-Security= overrides the defaults,
+	// an empty value drops the header
+	cfg.SecurityHeaders = maps.Clone(defaultSecurityHeaders)
+	if headersStr := getenv("SECURITY_HEADERS"); headersStr != "" {
+		for _, entry := range strings.Split(headersStr, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || name == "" || strings.ContainsAny(name, " :") {
+				return nil, fmt.Errorf("invalid SECURITY_HEADERS entry: %q, must be Header-Name=value", entry)
+			}
+			name = http.CanonicalHeaderKey(name)
+			if value = strings.TrimSpace(value); value == "" {
+				delete(cfg.SecurityHeaders, name)
+			} else {
+				cfg.SecurityHeaders[name] = value
+			}
+		}
 	}
-	defer rows.Close()
 
-	tokens := []Token{}
-	for rows.Next() {
-		var token Token
-		var issuedAtStr, expiresAtStr, updatedAtStr string
-		var isRevokedInt int
-		var clientIP, userAgent sql.NullString
+	if cfg.CookiePath == "" {
+		cfg.CookiePath = "/"
+	} else if !strings.HasPrefix(cfg.CookiePath, "/") {
+		return nil, fmt.Errorf("invalid COOKIE_PATH: %s, must start with /", cfg.CookiePath)
+	}
 
-		err := rows.Scan(&token.ID, &isRevokedInt, &issuedAtStr, &expiresAtStr, &updatedAtStr, &clientIP, &userAgent)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan token row: %w", err)
+	if env := getenv("APP_ENV"); env != "" {
+		if env != EnvDevelopment && env != EnvProduction {
+			return nil, fmt.Errorf("invalid APP_ENV: %s, must be %q or %q", env, EnvDevelopment, EnvProduction)
 		}
+		cfg.Env = env
+	}
 
-		if err := parseTokenFromDb(&token, isRevokedInt, issuedAtStr, expiresAtStr, updatedAtStr, clientIP, userAgent); err != nil {
-			return nil, err
+	cfg.ErrorDetail = ErrorDetailFull
+	if cfg.Env == EnvProduction {
+		cfg.ErrorDetail = ErrorDetailMinimal
+	}
+	if detail := getenv("ERROR_DETAIL"); detail != "" {
+		if detail != ErrorDetailFull && detail != ErrorDetailMinimal {
+			return nil, fmt.Errorf("invalid ERROR_DETAIL: %s, must be %q or %q", detail, ErrorDetailFull, ErrorDetailMinimal)
 		}
+		cfg.ErrorDetail = detail
+	}
 
-		tokens = append(tokens, token)
+	if logLevel := getenv("LOG_LEVEL"); logLevel != "" {
+		if logLevel != LogLevelInfo && logLevel != LogLevelDebug {
+			return nil, fmt.Errorf("invalid LOG_LEVEL: %s, must be %q or %q", logLevel, LogLevelInfo, LogLevelDebug)
+		}
+		cfg.LogLevel = logLevel
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating token rows: %w", err)
+	if rateStr := getenv("LOG_SAMPLE_RATE"); rateStr != "" {
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid LOG_SAMPLE_RATE: %s, must be between 0 and 1", rateStr)
+		}
+		cfg.LogSampleRate = rate
 	}
 
-	return tokens, nil
-}
+	if cfg.DatabaseURI == "" {
+		cfg.DatabaseURI = DefaultDatabaseSqliteURI
+	}
 
-// CreateToken creates a new token record in the database
-func (s *SqliteDB) CreateToken(ctx context.Context, token Token) error {
-	query := `
-	INSERT INTO tokens (
-	    id, is_revoked, issued_at, expires_at, updated_at, client_ip, user_agent
-	) VALUES (?, ?, ?, ?, ?, ?, ?);
-	`
+	if readConnsStr := getenv("DATABASE_READ_CONNS"); readConnsStr != "" {
+		n, err := strconv.Atoi(readConnsStr)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid DATABASE_READ_CONNS: %s, must be a positive number", readConnsStr)
+		}
+		cfg.DatabaseReadConns = n
+	}
 
-	isRevokedInt := 0
-	if token.IsRevoked {
-		isRevokedInt = 1
+	if waitStr := getenv("DATABASE_LOCK_WAIT_SEC"); waitStr != "" {
+		sec, err := strconv.Atoi(waitStr)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid DATABASE_LOCK_WAIT_SEC: %s, must be a non-negative number", waitStr)
+		}
+		cfg.DatabaseLockWait = time.Duration(sec) * time.Second
 	}
 
-	_, err := s.db.ExecContext(
-		ctx,
-		query,
-		token.ID,
-		isRevokedInt,
-		token.IssuedAt.Unix(),
-		token.ExpiresAt.Unix(),
-		token.UpdatedAt.Unix(),
-		token.ClientIP,
-		token.UserAgent,
-	)
-	if err != nil {
-		return fmt.Errorf("CreateToken: failed to insert: %w", err)
+	// CLAIM_COLUMNS=aud,scope: claims that get their own indexed column for /tokens filters.
+	// jti, iat, exp, nbf and sub are always stored and can't be listed.
+	if columnsStr := getenv("CLAIM_COLUMNS"); columnsStr != "" {
+		for _, name := range strings.Split(columnsStr, ",") {
+			name = strings.TrimSpace(name)
+			if !validClaimColumn(name) {
+				return nil, fmt.Errorf("invalid CLAIM_COLUMNS: %s, names must use only a-z, 0-9 and _ (at most 32)", columnsStr)
+			}
+			if slices.Contains([]string{"jti", "iat", "exp", "nbf", "sub"}, name) {
+				return nil, fmt.Errorf("invalid CLAIM_COLUMNS: %s, %s already has a column", columnsStr, name)
+			}
+			if slices.Contains(cfg.ClaimColumns, name) {
+				return nil, fmt.Errorf("invalid CLAIM_COLUMNS: %s, duplicate claim %s", columnsStr, name)
+			}
+			cfg.ClaimColumns = append(cfg.ClaimColumns, name)
+		}
 	}
-	return nil
-}
 
-// GetTokenByID retrieves a token by its ID from the database
-func (s *SqliteDB) GetTokenByID(ctx context.Context, tokenID string) (*Token, error) {
-	query := "SELECT id, is_revoked, issued_at, expires_at, updated_at, client_ip, user_agent FROM tokens WHERE id = ?"
+	// ROW_HMAC_KEY signs each token row's immutable fields so edits made directly in the
+	// database are detected on read. Kept apart from the JWT secret, which may be rotated.
+	if keyStr := getenv("ROW_HMAC_KEY"); keyStr != "" {
+		key, err := base64.StdEncoding.DecodeString(keyStr)
+		if err != nil || len(key) < 32 {
+			return nil, fmt.Errorf("invalid ROW_HMAC_KEY: must be a base64-encoded key of at least 32 bytes")
+		}
+		cfg.RowHMACKey = key
+	}
 
-	var token Token
-	var issuedAtStr, expiresAtStr, updatedAtStr string
-	var isRevokedInt int
-	var clientIP, userAgent sql.NullString
-
-	err := s.db.QueryRowContext(ctx, query, tokenID).Scan(
-		&token.ID,
-		&isRevokedInt,
-		&issuedAtStr,
-		&expiresAtStr,
-		&updatedAtStr,
-		&clientIP,
-		&userAgent,
-	)
-	if err == sql.ErrNoRows {
-		return nil, nil // Token not found
+	if thresholdStr := getenv("DB_BREAKER_THRESHOLD"); thresholdStr != "" {
+		n, err := strconv.Atoi(thresholdStr)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid DB_BREAKER_THRESHOLD: %s, must be a non-negative number", thresholdStr)
+		}
+		cfg.DBBreakerThreshold = n
 	}
-	if err != nil {
-		return nil, fmt.Errorf("failed to query token: %w", err)
+
+	if cooldownStr := getenv("DB_BREAKER_COOLDOWN_SEC"); cooldownStr != "" {
+		sec, err := strconv.Atoi(cooldownStr)
+		if err != nil || sec < 1 {
+			return nil, fmt.Errorf("invalid DB_BREAKER_COOLDOWN_SEC: %s, must be a positive number", cooldownStr)
+		}
+		cfg.DBBreakerCooldown = time.Duration(sec) * time.Second
 	}
 
-	if err := parseTokenFromDb(&token, isRevokedInt, issuedAtStr, expiresAtStr, updatedAtStr, clientIP, userAgent); err != nil {
-		return nil, err
+	if cfg.ServerAddr == "" {
+		cfg.ServerAddr = DefaultServerAddr
 	}
 
-	return &token, nil
-}
+	if maxStr := getenv("MAX_CONCURRENT_REQUESTS"); maxStr != "" {
+		n, err := strconv.Atoi(maxStr)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid MAX_CONCURRENT_REQUESTS: %s, must be a non-negative number", maxStr)
+		}
+		cfg.MaxConcurrent = n
+	}
 
-// CreateTokenUsage creates a new token usage record in the database
-func (s *SqliteDB) CreateTokenUsage(ctx context.Context, tokenID string, ts int64, clientIP, userAgent, method string, status int) error {
-	query := `
-	INSERT INTO token_usages (
+	// LISTEN_BACKLOG=4096 lets a connection storm queue instead of being refused; Linux caps it
+	// at net.core.somaxconn, which needs raising as well
+	if backlogStr := getenv("LISTEN_BACKLOG"); backlogStr != "" {
+		n, err := strconv.Atoi(backlogStr)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid LISTEN_BACKLOG: %s, must be a non-negative number", backlogStr)
+		}
+		cfg.ListenBacklog = n
+	}
+
+	// TCP_KEEPALIVE_SEC=60 probes idle connections less often than Go's 15s default, -1 disables
+	// probes, e.g. when a load balancer in front already detects dead peers
+	if keepAliveStr := getenv("TCP_KEEPALIVE_SEC"); keepAliveStr != "" {
+		sec, err := strconv.Atoi(keepAliveStr)
+		if err != nil || sec < -1 {
+			return nil, fmt.Errorf("invalid TCP_KEEPALIVE_SEC: %s, must be a non-negative number or -1", keepAliveStr)
+		}
+		cfg.TCPKeepAlive = time.Duration(sec) * time.Second
+	}
+
+	if sizeStr := getenv("VERIFY_CACHE_SIZE"); sizeStr != "" {
+		n, err := strconv.Atoi(sizeStr)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid VERIFY_CACHE_SIZE: %s, must be a non-negative number", sizeStr)
+		}
+		cfg.VerifyCacheSize = n
+	}
+
+	if ttlStr := getenv("VERIFY_CACHE_TTL_MS"); ttlStr != "" {
+		ms, err := strconv.Atoi(ttlStr)
+		if err != nil || ms < 1 {
+			return nil, fmt.Errorf("invalid VERIFY_CACHE_TTL_MS: %s, must be a positive number", ttlStr)
+		}
+		cfg.VerifyCacheTTL = time.Duration(ms) * time.Millisecond
+	}
+
+	if cfg.ServerPort == "" {
+		cfg.ServerPort = DefaultServerPort
+	} else if _, err := strconv.Atoi(cfg.ServerPort); err != nil {
+		return nil, fmt.Errorf("invalid port: %s, must be a number", cfg.ServerPort)
+	}
+
+	// Get JWT secret from a mounted secret file, environment, or use default
+	if secretFile := getenv("JWT_SECRET_FILE"); secretFile != "" {
+		provider := NewFileSecretProvider(secretFile)
+		if _, err := provider.Secret(); err != nil {
+			return nil, fmt.Errorf("invalid JWT_SECRET_FILE: %w", err)
+		}
+		cfg.JWTSecret = provider
+	} else {
+		jwtSecret := getenv("JWT_SECRET")
+		if jwtSecret == "" {
+			log.Println("Set default JWT secret")
+			jwtSecret = DefaultJWTSecret
+		}
+		cfg.JWTSecret = NewEnvSecretProvider(jwtSecret)
+	}
+
+	// JWT_SECRET_ROTATED_AT dates the current secret, its age is reported by /healthz
+	if rotatedAtStr := getenv("JWT_SECRET_ROTATED_AT"); rotatedAtStr != "" {
+		rotatedAt, err := parseTimeParam(rotatedAtStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_SECRET_ROTATED_AT: %s, must be Unix seconds or RFC3339", rotatedAtStr)
+		}
+		cfg.JWTSecretRotatedAt = rotatedAt
+	}
+
+	if maxAgeStr := getenv("JWT_SECRET_MAX_AGE_DAYS"); maxAgeStr != "" {
+		days, err := strconv.Atoi(maxAgeStr)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid JWT_SECRET_MAX_AGE_DAYS: %s, must be a non-negative number", maxAgeStr)
+		}
+		if days > 0 && cfg.JWTSecretRotatedAt.IsZero() {
+			return nil, fmt.Errorf("invalid JWT_SECRET_MAX_AGE_DAYS: %s, requires JWT_SECRET_ROTATED_AT", maxAgeStr)
+		}
+		cfg.JWTSecretMaxAge = time.Duration(days) * 24 * time.Hour
+	}
+
+	// Previous secret stays valid for verification until the grace window after rotation elapses.
+	// The window is dated by JWT_SECRET_ROTATED_AT, not the start time, so a restart or SIGHUP can't reopen it.
+	if previous := getenv("JWT_PREVIOUS_SECRET"); previous != "" {
+		if cfg.JWTSecretRotatedAt.IsZero() {
+			return nil, fmt.Errorf("invalid JWT_PREVIOUS_SECRET: requires JWT_SECRET_ROTATED_AT, the time the current secret replaced it")
+		}
+		cfg.JWTPreviousSecret = []byte(previous)
+
+		if graceStr := getenv("JWT_ROTATION_GRACE_SEC"); graceStr != "" {
+			sec, err := strconv.Atoi(graceStr)
+			if err != nil || sec < 0 {
+				return nil, fmt.Errorf("invalid JWT_ROTATION_GRACE_SEC: %s, must be a non-negative number", graceStr)
+			}
+			cfg.JWTRotationGrace = time.Duration(sec) * time.Second
+		}
+	}
+
+	// Nested JWT: signed tokens are wrapped in a JWE so holders can't read the claims.
+	// Encrypted tokens are ~1.4x larger and opaque to clients, which can no longer inspect exp.
+	if getenv("JWT_ENCRYPT") == "1" {
+		key, err := base64.StdEncoding.DecodeString(getenv("JWT_ENCRYPTION_KEY"))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid JWT_ENCRYPTION_KEY: JWT_ENCRYPT=1 requires a base64-encoded 32-byte key")
+		}
+		cfg.JWTEncryptionKey = key
+	}
+
+	// PASETO_SECRET_KEY is an Ed25519 key in hex, the 64-byte secret key (seed followed by the
+	// public key, as go-paseto exports it) or the 32-byte seed alone. Unlike JWT_SECRET it is
+	// asymmetric: verifiers outside this service only need the public half.
+	if keyStr := getenv("PASETO_SECRET_KEY"); keyStr != "" {
+		key, err := hex.DecodeString(keyStr)
+		switch {
+		case err == nil && len(key) == ed25519.SeedSize:
+			cfg.PasetoKey = ed25519.NewKeyFromSeed(key)
+		case err == nil && len(key) == ed25519.PrivateKeySize && bytes.Equal(ed25519.NewKeyFromSeed(key[:ed25519.SeedSize]), key):
+			cfg.PasetoKey = ed25519.PrivateKey(key)
+		default:
+			return nil, fmt.Errorf("invalid PASETO_SECRET_KEY: must be a hex-encoded Ed25519 secret key (64 bytes) or seed (32 bytes)")
+		}
+	}
+
+	// TOKEN_FORMAT=paseto issues PASETO v4.public tokens carrying the same claims, JWTs still verify
+	cfg.TokenFormat = TokenFormatJWT
+	if format := getenv("TOKEN_FORMAT"); format != "" {
+		switch format {
+		case TokenFormatJWT:
+		case TokenFormatPaseto:
+			if cfg.PasetoKey == nil {
+				return nil, fmt.Errorf("invalid TOKEN_FORMAT: %s requires PASETO_SECRET_KEY", format)
+			}
+		default:
+			return nil, fmt.Errorf("invalid TOKEN_FORMAT: %s, must be %q or %q", format, TokenFormatJWT, TokenFormatPaseto)
+		}
+		cfg.TokenFormat = format
+	}
+
+	cfg.VerifyExplain = getenv("VERIFY_EXPLAIN") == "1"
+	cfg.SelfTest = getenv("SELFTEST") == "1"
+	cfg.DPoPEnabled = getenv("DPOP_ENABLED") == "1"
+
+	// PUBLIC_URL=https://auth.example.com, needed for DPoP behind a proxy that terminates TLS
+	// or rewrites Host: the proof names the URI the client used, not the one the server sees
+	if publicURL := getenv("PUBLIC_URL"); publicURL != "" {
+		u, err := url.Parse(publicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return nil, fmt.Errorf("invalid PUBLIC_URL: %s, must be an origin like https://auth.example.com", publicURL)
+		}
+		cfg.PublicURL = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	}
+	cfg.OneTimeTokens = getenv("ONE_TIME_TOKENS") == "1"
+	cfg.UniqueNamedTokens = getenv("UNIQUE_NAMED_TOKENS") == "1"
+
+	// Service identity on / is served unless ROOT_INFO=0 (minimal-surface deployments)
+	cfg.RootInfo = getenv("ROOT_INFO") != "0"
+
+	if maxExpiryStr := getenv("ABSOLUTE_MAX_EXPIRY_SEC"); maxExpiryStr != "" {
+		sec, err := strconv.Atoi(maxExpiryStr)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid ABSOLUTE_MAX_EXPIRY_SEC: %s, must be a non-negative number", maxExpiryStr)
+		}
+		cfg.MaxExpiry = time.Duration(sec) * time.Second
+	}
+
+	if powStr := getenv("SIGNUP_POW_DIFFICULTY"); powStr != "" {
+		n, err := strconv.Atoi(powStr)
+		if err != nil || n < 0 || n > 64 {
+			return nil, fmt.Errorf("invalid SIGNUP_POW_DIFFICULTY: %s, must be a number between 0 and 64", powStr)
+		}
+		cfg.PowDifficulty = n
+	}
+
+	// The only key material is the shared secret, so asymmetric algorithms can't be configured
+	if alg := getenv("JWT_ALG"); alg != "" {
+		method := jwt.GetSigningMethod(alg)
+		if _, ok := method.(*jwt.SigningMethodHMAC); !ok {
+			switch method {
+			case nil:
+				return nil, fmt.Errorf("invalid JWT_ALG: %s, unknown algorithm", alg)
+			case jwt.SigningMethodNone:
+				return nil, fmt.Errorf("invalid JWT_ALG: %s, tokens must be signed", alg)
+			default:
+				return nil, fmt.Errorf("invalid JWT_ALG: %s requires JWT_PRIVATE_KEY_FILE, which is not supported, use HS256, HS384 or HS512 with JWT_SECRET", alg)
+			}
+		}
+		cfg.JWTAlg = alg
+	}
+
+	// RFC 7518 section 3.2: the key must be at least as long as the hash output
+	secret, err := cfg.JWTSecret.Secret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWT secret: %w", err)
+	}
+	if minLen := jwt.GetSigningMethod(cfg.JWTAlg).(*jwt.SigningMethodHMAC).Hash.Size(); len(secret) < minLen {
+		if cfg.Env == EnvProduction {
+			return nil, fmt.Errorf("invalid JWT secret: %d bytes, %s requires at least %d", len(secret), cfg.JWTAlg, minLen)
+		}
+		log.Printf("LoadConfig, warning: JWT secret is %d bytes, %s requires at least %d (enforced with APP_ENV=production)", len(secret), cfg.JWTAlg, minLen)
+	}
+	// The default secret is public, long enough or not
+	if string(secret) == DefaultJWTSecret && cfg.Env == EnvProduction {
+		return nil, fmt.Errorf("invalid JWT secret: the built-in default can't be used with APP_ENV=production, set JWT_SECRET or JWT_SECRET_FILE")
+	}
+
+	// JWT_TENANTS=acme,globex, each tenant needs JWT_TENANT_<NAME>_SECRET and may set
+	// JWT_TENANT_<NAME>_ISSUER (defaults to the tenant name)
+	if tenantsStr := getenv("JWT_TENANTS"); tenantsStr != "" {
+		minLen := jwt.GetSigningMethod(cfg.JWTAlg).(*jwt.SigningMethodHMAC).Hash.Size()
+		cfg.Tenants = map[string]Tenant{}
+		for _, name := range strings.Split(tenantsStr, ",") {
+			name = strings.TrimSpace(name)
+			if !validTenantName(name) {
+				return nil, fmt.Errorf("invalid JWT_TENANTS: %s, names must be non-empty and use only a-z, 0-9 and -", tenantsStr)
+			}
+			if _, ok := cfg.Tenants[name]; ok {
+				return nil, fmt.Errorf("invalid JWT_TENANTS: %s, duplicate tenant %s", tenantsStr, name)
+			}
+
+			prefix := "JWT_TENANT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+			secret := getenv(prefix + "_SECRET")
+			if secret == "" {
+				return nil, fmt.Errorf("invalid JWT_TENANTS: tenant %s has no %s_SECRET", name, prefix)
+			}
+			if len(secret) < minLen {
+				if cfg.Env == EnvProduction {
+					return nil, fmt.Errorf("invalid %s_SECRET: %d bytes, %s requires at least %d", prefix, len(secret), cfg.JWTAlg, minLen)
+				}
+				log.Printf("LoadConfig, warning: %s_SECRET is %d bytes, %s requires at least %d (enforced with APP_ENV=production)", prefix, len(secret), cfg.JWTAlg, minLen)
+			}
+			issuer := getenv(prefix + "_ISSUER")
+			if issuer == "" {
+				issuer = name
+			}
+			cfg.Tenants[name] = Tenant{Issuer: issuer, Secret: []byte(secret)}
+		}
+		if cfg.TokenFormat == TokenFormatPaseto {
+			return nil, fmt.Errorf("invalid JWT_TENANTS: %s, tenant keys are HMAC secrets and can't sign TOKEN_FORMAT=%s", tenantsStr, cfg.TokenFormat)
+		}
+	}
+
+	// VERIFY_ALLOWED_ALGS=HS256,HS512, only HMAC algorithms since the keys are shared secrets.
+	// Defaults to exactly the signing algorithm.
+	cfg.VerifyAllowedAlgs = []string{cfg.JWTAlg}
+	if algsStr := getenv("VERIFY_ALLOWED_ALGS"); algsStr != "" {
+		cfg.VerifyAllowedAlgs = nil
+		for _, alg := range strings.Split(algsStr, ",") {
+			alg = strings.TrimSpace(alg)
+			if _, ok := jwt.GetSigningMethod(alg).(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("invalid VERIFY_ALLOWED_ALGS: %s, must be a list of HS256, HS384, HS512", algsStr)
+			}
+			cfg.VerifyAllowedAlgs = append(cfg.VerifyAllowedAlgs, alg)
+		}
+		if !slices.Contains(cfg.VerifyAllowedAlgs, cfg.JWTAlg) {
+			return nil, fmt.Errorf("invalid VERIFY_ALLOWED_ALGS: %s, must include JWT_ALG %s or issued tokens won't verify", algsStr, cfg.JWTAlg)
+		}
+	}
+
+	// JWT_TYP=at+jwt marks access tokens per RFC 9068, VERIFY_EXPECTED_TYP rejects tokens of another type
+	cfg.JWTTyp = DefaultJWTTyp
+	if typ := getenv("JWT_TYP"); typ != "" {
+		cfg.JWTTyp = typ
+	}
+	cfg.JWTCty = getenv("JWT_CTY")
+	if expected := getenv("VERIFY_EXPECTED_TYP"); expected != "" {
+		if normalizeTyp(expected) != normalizeTyp(cfg.JWTTyp) {
+			return nil, fmt.Errorf("invalid VERIFY_EXPECTED_TYP: %s, must match JWT_TYP %s or issued tokens won't verify", expected, cfg.JWTTyp)
+		}
+		cfg.VerifyExpectedTyp = expected
+	}
+
+	// A subject names whose sessions, exports and named tokens a token may manage, so it can't
+	// be self-asserted. SUBJECT_AUTH_TOKEN is held by the front end that authenticates users,
+	// signups naming a subject must present it as a bearer token. Unset, subjects are refused.
+	if token := getenv("SUBJECT_AUTH_TOKEN"); token != "" {
+		if len(token) < 32 {
+			return nil, fmt.Errorf("invalid SUBJECT_AUTH_TOKEN: %d bytes, must be at least 32", len(token))
+		}
+		cfg.SubjectAuthToken = []byte(token)
+	}
+
+	// The admin listener revokes tokens and hands out the database, being off the public
+	// interface doesn't make everyone who can reach it an operator
+	if token := getenv("ADMIN_TOKEN"); token != "" {
+		if len(token) < 32 {
+			return nil, fmt.Errorf("invalid ADMIN_TOKEN: %d bytes, must be at least 32", len(token))
+		}
+		cfg.AdminToken = []byte(token)
+
+		// Whoever can sign tokens must not be an operator too, and the other way around
+		signing := [][]byte{cfg.JWTPreviousSecret}
+		if secret, err := cfg.JWTSecret.Secret(); err == nil {
+			signing = append(signing, secret)
+		}
+		for _, tenant := range cfg.Tenants {
+			signing = append(signing, tenant.Secret)
+		}
+		if slices.ContainsFunc(signing, func(secret []byte) bool { return hmac.Equal(secret, cfg.AdminToken) }) {
+			return nil, fmt.Errorf("invalid ADMIN_TOKEN: must differ from the JWT signing secrets")
+		}
+	}
+	if cfg.ClientAccounting && cfg.SubjectAuthToken == nil {
+		return nil, fmt.Errorf("invalid CLIENT_ACCOUNTING: 1, counts only signups authenticated with SUBJECT_AUTH_TOKEN, set it")
+	}
+	if cfg.PprofAddr != "" && cfg.AdminToken == nil {
+		return nil, fmt.Errorf("invalid PPROF_ADDR: %s, the admin listener requires ADMIN_TOKEN", cfg.PprofAddr)
+	}
+
+	cfg.OAuthIssuer = getenv("OAUTH_ISSUER")
+	cfg.OAuthAudience = getenv("OAUTH_AUDIENCE")
+
+	// OAUTH_PROFILE=rfc9068 issues and accepts only RFC 9068 access tokens: typ at+jwt,
+	// and iss, exp, aud, sub, client_id, iat and jti all present
+	if profile := getenv("OAUTH_PROFILE"); profile != "" {
+		if profile != OAuthProfileRFC9068 {
+			return nil, fmt.Errorf("invalid OAUTH_PROFILE: %s, must be %q", profile, OAuthProfileRFC9068)
+		}
+		if cfg.OAuthIssuer == "" || cfg.OAuthAudience == "" {
+			return nil, fmt.Errorf("invalid OAUTH_PROFILE: %s requires OAUTH_ISSUER and OAUTH_AUDIENCE", profile)
+		}
+		if cfg.SubjectAuthToken == nil {
+			return nil, fmt.Errorf("invalid OAUTH_PROFILE: %s requires SUBJECT_AUTH_TOKEN, every token has an authenticated subject", profile)
+		}
+		if getenv("JWT_TYP") != "" && normalizeTyp(cfg.JWTTyp) != "at+jwt" {
+			return nil, fmt.Errorf("invalid JWT_TYP: %s, OAUTH_PROFILE=%s requires at+jwt", cfg.JWTTyp, profile)
+		}
+		if cfg.TokenFormat == TokenFormatPaseto {
+			return nil, fmt.Errorf("invalid OAUTH_PROFILE: %s, RFC 9068 access tokens are JWTs, unset TOKEN_FORMAT=%s", profile, cfg.TokenFormat)
+		}
+		if cfg.PasetoKey != nil {
+			return nil, fmt.Errorf("invalid OAUTH_PROFILE: %s, RFC 9068 access tokens are JWTs, unset PASETO_SECRET_KEY", profile)
+		}
+		cfg.OAuthProfile = profile
+		cfg.JWTTyp, cfg.VerifyExpectedTyp = "at+jwt", "at+jwt"
+	}
+
+	if windowStr := getenv("ISSUANCE_WINDOW_SEC"); windowStr != "" {
+		sec, err := strconv.Atoi(windowStr)
+		if err != nil || sec <= 0 {
+			return nil, fmt.Errorf("invalid ISSUANCE_WINDOW_SEC: %s, must be a positive number", windowStr)
+		}
+		cfg.IssuanceWindow = time.Duration(sec) * time.Second
+	}
+
+	if historyStr := getenv("ISSUANCE_HISTORY_SEC"); historyStr != "" {
+		sec, err := strconv.Atoi(historyStr)
+		if err != nil || sec <= 0 {
+			return nil, fmt.Errorf("invalid ISSUANCE_HISTORY_SEC: %s, must be a positive number", historyStr)
+		}
+		cfg.IssuanceHistory = time.Duration(sec) * time.Second
+	}
+
+	if intervalStr := getenv("VACUUM_INTERVAL_SEC"); intervalStr != "" {
+		sec, err := strconv.Atoi(intervalStr)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid VACUUM_INTERVAL_SEC: %s, must be a non-negative number", intervalStr)
+		}
+		cfg.VacuumInterval = time.Duration(sec) * time.Second
+	}
+
+	// VACUUM_WINDOW=2-5 limits scheduled and on-demand runs to 02:00-04:59 local time, default is any hour
+	cfg.VacuumWindowStart, cfg.VacuumWindowEnd = 0, 24
+	if windowStr := getenv("VACUUM_WINDOW"); windowStr != "" {
+		startStr, endStr, _ := strings.Cut(windowStr, "-")
+		start, err1 := strconv.Atoi(startStr)
+		end, err2 := strconv.Atoi(endStr)
+		if err1 != nil || err2 != nil || start < 0 || end > 24 || start >= end {
+			return nil, fmt.Errorf("invalid VACUUM_WINDOW: %s, must be START-END hours with 0 <= START < END <= 24", windowStr)
+		}
+		cfg.VacuumWindowStart, cfg.VacuumWindowEnd = start, end
+	}
+
+	// BACKUP_DIR needs free space for a full copy of the database while /admin/backup streams it
+	if dir := getenv("BACKUP_DIR"); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("invalid BACKUP_DIR: %s, must be an existing directory", dir)
+		}
+		cfg.BackupDir = dir
+	}
+
+	// Emergency kill switch for whole subjects, without revoking their tokens one by one
+	cfg.BlockedSubjects = parseSubjectSet(getenv("BLOCKED_SUBJECTS"))
+	cfg.AllowedSubjects = parseSubjectSet(getenv("ALLOWED_SUBJECTS"))
+
+	if nStr := getenv("MAX_CUSTOM_CLAIMS"); nStr != "" {
+		n, err := strconv.Atoi(nStr)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid MAX_CUSTOM_CLAIMS: %s, must be a non-negative number", nStr)
+		}
+		cfg.MaxCustomClaims = n
+	}
+
+	if bytesStr := getenv("MAX_CUSTOM_CLAIMS_BYTES"); bytesStr != "" {
+		n, err := strconv.Atoi(bytesStr)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid MAX_CUSTOM_CLAIMS_BYTES: %s, must be a non-negative number", bytesStr)
+		}
+		cfg.MaxCustomClaimsBytes = n
+	}
+
+	if bytesStr := getenv("MAX_TOKEN_BYTES"); bytesStr != "" {
+		n, err := strconv.Atoi(bytesStr)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid MAX_TOKEN_BYTES: %s, must be a non-negative number", bytesStr)
+		}
+		cfg.MaxTokenBytes = n
+	}
+
+	// MAINTENANCE_MODE=1 freezes issuance and revocation, e.g. during a migration, flipped with SIGHUP
+	if retryStr := getenv("MAINTENANCE_RETRY_AFTER_SEC"); retryStr != "" {
+		sec, err := strconv.Atoi(retryStr)
+		if err != nil || sec <= 0 {
+			return nil, fmt.Errorf("invalid MAINTENANCE_RETRY_AFTER_SEC: %s, must be a positive number", retryStr)
+		}
+		cfg.MaintenanceRetryAfter = time.Duration(sec) * time.Second
+	}
+
+	// IDLE_TIMEOUT_SEC=1800 ends sessions unused for 30 minutes even though exp hasn't passed
+	if idleStr := getenv("IDLE_TIMEOUT_SEC"); idleStr != "" {
+		sec, err := strconv.Atoi(idleStr)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid IDLE_TIMEOUT_SEC: %s, must be a non-negative number", idleStr)
+		}
+		cfg.IdleTimeout = time.Duration(sec) * time.Second
+	}
+
+	// MAX_TOTAL_TOKENS bounds the tokens table on small disks, at the cap expired tokens are
+	// deleted to make room and signup answers 503 when there are none
+	if maxStr := getenv("MAX_TOTAL_TOKENS"); maxStr != "" {
+		n, err := strconv.ParseInt(maxStr, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid MAX_TOTAL_TOKENS: %s, must be a non-negative number", maxStr)
+		}
+		cfg.MaxTotalTokens = n
+	}
+
+	// CLAIMS_TRANSFORMER_CMD gets the claims as a JSON object on stdin and prints the claims to sign.
+	// Split on spaces and run without a shell.
+	cfg.ClaimsTransformerCmd = strings.Fields(getenv("CLAIMS_TRANSFORMER_CMD"))
+	if timeoutStr := getenv("CLAIMS_TRANSFORMER_TIMEOUT_MS"); timeoutStr != "" {
+		ms, err := strconv.Atoi(timeoutStr)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("invalid CLAIMS_TRANSFORMER_TIMEOUT_MS: %s, must be a positive number", timeoutStr)
+		}
+		cfg.ClaimsTransformerTimeout = time.Duration(ms) * time.Millisecond
+	}
+
+	// Sliding tokens (signup with "sliding": true) are re-issued on use, never past this lifetime
+	if lifetimeStr := getenv("SLIDING_MAX_LIFETIME_SEC"); lifetimeStr != "" {
+		sec, err := strconv.Atoi(lifetimeStr)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid SLIDING_MAX_LIFETIME_SEC: %s, must be a non-negative number", lifetimeStr)
+		}
+		cfg.SlidingMaxLifetime = time.Duration(sec) * time.Second
+	}
+
+	// REQUEST_TIMEOUT_SEC=30 bounds every route, ROUTE_TIMEOUTS single ones. Both are off by default:
+	// the deadline is enforced by http.TimeoutHandler, which buffers the whole response and hides
+	// http.Flusher, so large or streamed responses (/tokens/export) are better left at 0.
+	if timeoutStr := getenv("REQUEST_TIMEOUT_SEC"); timeoutStr != "" {
+		sec, err := strconv.Atoi(timeoutStr)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid REQUEST_TIMEOUT_SEC: %s, must be a non-negative number", timeoutStr)
+		}
+		cfg.RequestTimeout = time.Duration(sec) * time.Second
+	}
+
+	// ROUTE_TIMEOUTS=/tokens=60,/tokens/auth=2,/tokens/export=0
+	if routesStr := getenv("ROUTE_TIMEOUTS"); routesStr != "" {
+		for _, entry := range strings.Split(routesStr, ",") {
+			path, secStr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			sec, err := strconv.Atoi(secStr)
+			if !ok || !strings.HasPrefix(path, "/") || err != nil || sec < 0 {
+				return nil, fmt.Errorf("invalid ROUTE_TIMEOUTS entry: %q, must be /path=seconds", entry)
+			}
+			cfg.RouteTimeouts[path] = time.Duration(sec) * time.Second
+		}
+	}
+
+	// ENABLED_ENDPOINTS=/tokens/validate,/healthz registers only those routes (a verify-only instance),
+	// DISABLED_ENDPOINTS=/tokens/validate_unverified registers everything else. Not both.
+	enabledStr, disabledStr := getenv("ENABLED_ENDPOINTS"), getenv("DISABLED_ENDPOINTS")
+	switch {
+	case enabledStr != "" && disabledStr != "":
+		return nil, fmt.Errorf("invalid DISABLED_ENDPOINTS: can't be combined with ENABLED_ENDPOINTS")
+	case enabledStr != "":
+		enabled, err := parseEndpointList("ENABLED_ENDPOINTS", enabledStr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.DisabledEndpoints = make(map[string]bool)
+		for _, pattern := range endpointPatterns {
+			if !enabled[pattern] {
+				cfg.DisabledEndpoints[pattern] = true
+			}
+		}
+	case disabledStr != "":
+		disabled, err := parseEndpointList("DISABLED_ENDPOINTS", disabledStr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.DisabledEndpoints = disabled
+	}
+
+	if policy := getenv("ABSOLUTE_MAX_EXPIRY_POLICY"); policy != "" {
+		if policy != MaxExpiryPolicyClamp && policy != MaxExpiryPolicyReject {
+			return nil, fmt.Errorf("invalid ABSOLUTE_MAX_EXPIRY_POLICY: %s, must be %q or %q", policy, MaxExpiryPolicyClamp, MaxExpiryPolicyReject)
+		}
+		cfg.MaxExpiryPolicy = policy
+	}
+
+	if clockSkewStr := getenv("JWT_CLOCK_SKEW_SEC"); clockSkewStr != "" {
+		sec, err := strconv.Atoi(clockSkewStr)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("invalid JWT_CLOCK_SKEW_SEC: %s, must be a non-negative number", clockSkewStr)
+		}
+		cfg.ClockSkew = time.Duration(sec) * time.Second
+	}
+
+	// Time claims are optional on verification, a token without exp never expires.
+	// REQUIRE_EXP=1 (and REQUIRE_NBF, REQUIRE_IAT) rejects such tokens, e.g. from external issuers.
+	for _, name := range []string{"exp", "nbf", "iat"} {
+		if getenv("REQUIRE_"+strings.ToUpper(name)) == "1" {
+			cfg.RequiredTimeClaims = append(cfg.RequiredTimeClaims, name)
+		}
+	}
+
+	// Opt-in clock sanity check, NTP_CHECK_SERVER=pool.ntp.org
+	if ntpServer := getenv("NTP_CHECK_SERVER"); ntpServer != "" {
+		if _, _, err := net.SplitHostPort(ntpServer); err != nil {
+			ntpServer = net.JoinHostPort(ntpServer, "123")
+		}
+		cfg.NTPCheckServer = ntpServer
+	}
+
+	if driftStr := getenv("NTP_MAX_DRIFT_MS"); driftStr != "" {
+		ms, err := strconv.Atoi(driftStr)
+		if err != nil || ms < 1 {
+			return nil, fmt.Errorf("invalid NTP_MAX_DRIFT_MS: %s, must be a positive number", driftStr)
+		}
+		cfg.NTPMaxDrift = time.Duration(ms) * time.Millisecond
+	}
+
+	return cfg, nil
+}
+
+// --- ERRORS ---
+
+// Domain errors returned by the store and token validation, use errors.Is to branch on them
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenExists   = errors.New("token already exists")
+	ErrTokenRevoked  = errors.New("token revoked")
+	ErrTokenExpired  = errors.New("token expired")
+	ErrTokenIdle     = errors.New("token idle for longer than the idle timeout")
+
+	ErrTokenNotYetValid      = errors.New("token is not valid yet")
+	ErrTokenMissingClaim     = errors.New("token lacks a required claim")
+	ErrTokenInvalidClaim     = errors.New("token claim is not a valid number")
+	ErrTokenUsedBeforeIssued = errors.New("token used before issued")
+
+	ErrSchemaOutdated = errors.New("database schema out of date, run migrations")
+
+	ErrSubjectBlocked = errors.New("token subject is blocked")
+
+	ErrTokenUndecryptable = errors.New("token decryption failed")
+
+	ErrDPoPProofInvalid = errors.New("invalid DPoP proof")
+
+	ErrNonceUsed = errors.New("one-time token already used")
+
+	ErrTokenTampered = errors.New("token row signature mismatch")
+
+	ErrTokenTypeMismatch = errors.New("unexpected token type")
+
+	ErrTokenProfile = errors.New("token does not conform to the OAuth profile")
+
+	ErrTokenAudience = errors.New("token not intended for the requested audience")
+
+	ErrStorageFull         = errors.New("database disk is full")
+	ErrStorageReadOnly     = errors.New("database is not writable")
+	ErrDatabaseUnavailable = errors.New("database unavailable, circuit breaker open")
+)
+
+// --- DATA STRUCTURE ---
+
+// Token represents a JWT token
+type Token struct {
+	ID        string    `json:"id"` // jti (UUID)
+	IsRevoked bool      `json:"is_revoked"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	Subject   string    `json:"subject,omitempty"` // sub claim, empty for anonymous tokens
+	Name      string    `json:"name,omitempty"`    // operator label, never put into the claims
+
+	Labels map[string]string `json:"labels,omitempty"` // free-form key/value tags, never put into the claims
+
+	// Optional audit fields:
+	Token string `json:"token,omitempty"` // jwt full token string
+
+	// CLAIM_COLUMNS values, written by CreateToken for filtering but not read back
+	ClaimValues map[string]string `json:"-"`
+}
+
+// SubjectExport is the data export of a subject: every token issued to it and every recorded use
+type SubjectExport struct {
+	Subject     string       `json:"subject"`
+	GeneratedAt time.Time    `json:"generated_at"`
+	Tokens      []Token      `json:"tokens"`
+	Usages      []TokenUsage `json:"usages"`
+}
+
+// SignedExport wraps an export with an HMAC over its exact bytes, see /tokens/export/verify
+type SignedExport struct {
+	Export    json.RawMessage `json:"export"`
+	Alg       string          `json:"alg"`       // always "HS256"
+	Signature string          `json:"signature"` // base64url HMAC-SHA256 of export
+}
+
+// Session represents an active token of a subject (device session) with its last use
+type Session struct {
+	Token
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// TokenMeta is the mutable, non-security metadata of a token accepted by PATCH /tokens/{id}.
+// Expiry, revocation and claims are deliberately absent, so patches naming them are rejected.
+type TokenMeta struct {
+	Name   *string           `json:"name"`   // "" clears the name
+	Labels map[string]string `json:"labels"` // replaces all labels, {} clears them
+}
+
+// Limits on TokenMeta.Labels
+const (
+	maxTokenLabels     = 32
+	maxTokenLabelKey   = 63
+	maxTokenLabelValue = 255
+)
+
+// validLabels reports whether labels are within the limits, keys must be non-empty
+func validLabels(labels map[string]string) bool {
+	if len(labels) > maxTokenLabels {
+		return false
+	}
+	for k, v := range labels {
+		if k == "" || len(k) > maxTokenLabelKey || len(v) > maxTokenLabelValue {
+			return false
+		}
+	}
+	return true
+}
+
+// TokenUsage represents a single usage event for a token
+type TokenUsage struct {
+	ID        int64     `json:"id"`
+	TokenID   string    `json:"token_id"`
+	TS        time.Time `json:"ts"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	Method    string    `json:"method"`
+	Status    int       `json:"status"`
+}
+
+// TokenExplanation describes why a token failed verification (opt-in, leaks validity details)
+type TokenExplanation struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// BatchVerifyResult is the outcome for one token of /tokens/validate/batch
+type BatchVerifyResult struct {
+	Valid     bool       `json:"valid"`
+	Reason    string     `json:"reason,omitempty"` // as in TokenExplanation, when not valid
+	JTI       string     `json:"jti,omitempty"`
+	Subject   string     `json:"subject,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// BatchVerifyResponse represents the /tokens/validate/batch response body
+type BatchVerifyResponse struct {
+	Results []BatchVerifyResult `json:"results"` // in request order
+}
+
+// TokenTTL represents the /tokens/ttl response body
+type TokenTTL struct {
+	TTLSec  int64 `json:"ttl_sec"` // seconds until exp, 0 once expired
+	Expired bool  `json:"expired"`
+	Revoked bool  `json:"revoked"`
+}
+
+// SignUpRequest represents the /tokens/auth parameters, sent as a form or a JSON body
+type SignUpRequest struct {
+	ExpiresSec   *int64       `json:"expires_sec,omitempty"`
+	Subject      string       `json:"subject,omitempty"`
+	Name         string       `json:"name,omitempty"`
+	PowChallenge string       `json:"pow_challenge,omitempty"`
+	PowSolution  string       `json:"pow_solution,omitempty"`
+	Tenant       string       `json:"tenant,omitempty"`    // one of JWT_TENANTS, empty for the default key
+	Sliding      bool         `json:"sliding,omitempty"`   // renew on use, needs SLIDING_MAX_LIFETIME_SEC
+	ClientID     string       `json:"client_id,omitempty"` // OAuth client the token is issued to, required by OAUTH_PROFILE
+	Audience     audienceList `json:"aud,omitempty"`       // intended recipients, a string or an array
+
+	// Extra claims signed into the token, registered claim names are reserved
+	Claims map[string]any `json:"claims,omitempty"`
+}
+
+// audienceList is the aud of a signup request, given as a single string or an array of them
+type audienceList []string
+
+func (a *audienceList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audienceList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("aud must be a string or an array of strings")
+	}
+	*a = list
+	return nil
+}
+
+// SignUpResponse represents the /tokens/auth response body, shaped like an OAuth 2.0 token response
+type SignUpResponse struct {
+	Token     string    `json:"token"`
+	JTI       string    `json:"jti"`
+	TokenType string    `json:"token_type"` // "Bearer", or "DPoP" for key-bound tokens
+	ExpiresAt time.Time `json:"expires_at"`
+	ExpiresIn int64     `json:"expires_in"` // seconds
+}
+
+// ReissueRequest represents the optional /tokens/reissue request body
+type ReissueRequest struct {
+	ExpiresSec *int64 `json:"expires_sec,omitempty"` // new lifetime from now, 24 hours when omitted
+}
+
+// PowChallenge represents the /tokens/auth/challenge response body
+type PowChallenge struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+	Algorithm  string `json:"algorithm"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+// ServiceInfo represents the / response body
+type ServiceInfo struct {
+	Name       string            `json:"name"`
+	JWTVersion string            `json:"jwt_version"`
+	Links      map[string]string `json:"links"`
+}
+
+// ErrorResponse represents the JSON error envelope
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody holds a machine-readable error code and a human-readable message
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// RevocationList represents the /revocations response body
+type RevocationList struct {
+	Since int64    `json:"since"`
+	JTIs  []string `json:"jtis"`
+}
+
+// HealthCheck represents the result of a single dependency check
+type HealthCheck struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	FreeBytes uint64  `json:"free_bytes,omitempty"`
+	Message   string  `json:"message,omitempty"`
+}
+
+// VacuumResult represents the /admin/vacuum response body
+type VacuumResult struct {
+	BeforeBytes int64   `json:"before_bytes"`
+	AfterBytes  int64   `json:"after_bytes"`
+	DurationMs  float64 `json:"duration_ms"`
+}
+
+// SubjectIssuance is the number of tokens a subject was issued in a window
+type SubjectIssuance struct {
+	Subject string `json:"subject"`
+	Issued  int64  `json:"issued"`
+}
+
+// IssuanceReport represents the /admin/issuance response body
+type IssuanceReport struct {
+	WindowSec int64             `json:"window_sec"`
+	Subjects  []SubjectIssuance `json:"subjects"` // busiest first
+}
+
+// IssuanceBucket is the number of tokens issued in the bucket starting at Start
+type IssuanceBucket struct {
+	Start  time.Time `json:"start"`
+	Issued int64     `json:"issued"`
+}
+
+// IssuanceHistogram represents the /admin/issuance/histogram response body
+type IssuanceHistogram struct {
+	Bucket     string           `json:"bucket"` // "hour" or "day", UTC
+	HistorySec int64            `json:"history_sec"`
+	Buckets    []IssuanceBucket `json:"buckets"` // oldest first, empty buckets included
+}
+
+// ClientUsage is the number of tokens issued to one client_id
+type ClientUsage struct {
+	ClientID string `json:"client_id"`
+	Issued   int64  `json:"issued"`
+}
+
+// UsageReport represents the /admin/usage response body
+type UsageReport struct {
+	Since   time.Time     `json:"since"` // rounded down to the hour
+	Until   time.Time     `json:"until"`
+	Clients []ClientUsage `json:"clients"` // busiest first
+}
+
+// HealthReport represents the /healthz response body
+type HealthReport struct {
+	Status   string                 `json:"status"`
+	Checks   map[string]HealthCheck `json:"checks"`
+	Panics   int64                  `json:"panics"`    // handler panics recovered since start
+	InFlight int64                  `json:"in_flight"` // requests being handled, this one included
+
+	VerifyCache *VerifyCacheStats `json:"verify_cache,omitempty"`
+	SigningKey  SigningKeyStats   `json:"signing_key"`
+	Maintenance bool              `json:"maintenance"` // MAINTENANCE_MODE, mutating endpoints refused
+}
+
+// SigningKeyStats reports how stale the signing secret is, for alerting before its rotation is due
+type SigningKeyStats struct {
+	AgeSec            *int64   `json:"age_sec,omitempty"`             // unset without JWT_SECRET_ROTATED_AT
+	DaysUntilRotation *float64 `json:"days_until_rotation,omitempty"` // negative once overdue, unset without JWT_SECRET_MAX_AGE_DAYS
+	VerificationKeys  int      `json:"verification_keys"`             // secrets tokens are currently checked against
+}
+
+// --- DATABASE ---
+
+// SqliteDB represents a SQLite database connection.
+// Writes go through db (single connection), reads through the rdb pool:
+// SQLite in WAL mode allows concurrent readers alongside one writer.
+type SqliteDB struct {
+	db   *sql.DB
+	rdb  *sql.DB
+	path string // database file path, used for disk space checks
+
+	breaker *circuitBreaker // nil when disabled
+
+	claimColumns []string // CLAIM_COLUMNS, created by RunMigrations and filled by CreateToken
+
+	rowKey []byte // ROW_HMAC_KEY, nil when rows are not signed
+}
+
+// sqliteFilePath extracts the file path from a SQLite URI (strips "file:" prefix and query)
+func sqliteFilePath(uri string) string {
+	path := strings.TrimPrefix(uri, "file:")
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// storageError tags SQLite write failures caused by the environment with ErrStorageFull
+// or ErrStorageReadOnly, keeping the driver error in the chain
+func storageError(err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	switch sqliteErr.Code {
+	case sqlite3.ErrFull:
+		return fmt.Errorf("%w: %w", ErrStorageFull, err)
+	case sqlite3.ErrReadonly, sqlite3.ErrPerm, sqlite3.ErrCantOpen:
+		return fmt.Errorf("%w: %w", ErrStorageReadOnly, err)
+	}
+	return err
+}
+
+// checkWritable fails if the process can't write the database file, or create it in its directory.
+// The driver opens lazily and would only report this on the first write.
+func checkWritable(path string) error {
+	const wOK = 2 // W_OK
+	target := path
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		target = filepath.Dir(path)
+	}
+	if err := syscall.Access(target, wOK); err != nil {
+		return fmt.Errorf("%s is not writable by uid %d: %w: %w", target, os.Getuid(), ErrStorageReadOnly, err)
+	}
+	return nil
+}
+
+// openSqliteReadPool opens a read-only connection pool to the database file
+func openSqliteReadPool(path string, readConns int) (*sql.DB, error) {
+	params := url.Values{}
+	params.Add("mode", "ro")
+	params.Add("_query_only", "true")
+
+	readUri := "file:" + path + "?" + params.Encode()
+	rdb, err := sql.Open("sqlite3", readUri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open read pool with DSN '%s': %w", readUri, err)
+	}
+
+	rdb.SetMaxOpenConns(readConns)
+	rdb.SetMaxIdleConns(readConns)
+	rdb.SetConnMaxLifetime(time.Hour)
+
+	return rdb, nil
+}
+
+// NewSqliteDB creates a new SQLite database connection with specified options.
+// readConns > 1 enables a separate read-only pool for file-backed databases.
+func NewSqliteDB(uri string, enableWal bool, syncPragma string, readConns int) (*SqliteDB, error) {
+	if path := sqliteFilePath(uri); path != "" && path != ":memory:" && !strings.Contains(uri, "mode=memory") {
+		if err := checkWritable(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Pragmas in the DSN apply to every connection the pool opens, not only the first.
+	// Foreign keys are crucial for ON DELETE CASCADE and other FK actions to work.
+	params := url.Values{}
+	params.Add("_synchronous", "NORMAL")
+	params.Add("_journal_mode", "WAL")
+	params.Add("_foreign_keys", "1")
+
+	constructedUri := uri
+	if len(params) > 0 {
+		if strings.Contains(uri, "?") {
+			constructedUri += "&" + params.Encode()
+		} else {
+			constructedUri += "?" + params.Encode()
+		}
+	}
+
+	db, err := sql.Open("sqlite3", constructedUri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database with DSN '%s': %w", constructedUri, err)
+	}
+
+	// Configure connection pool settings
+	db.SetMaxOpenConns(1) // SQLite only supports one writer at a time
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(time.Hour)
+
+	sdb := &SqliteDB{db: db, rdb: db, path: sqliteFilePath(uri)}
+
+	// In-memory databases are per-connection, so they can't have a separate read pool
+	if readConns > 1 && sdb.path != "" && sdb.path != ":memory:" && !strings.Contains(uri, "mode=memory") {
+		rdb, err := openSqliteReadPool(sdb.path, readConns)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		sdb.rdb = rdb
+	}
+
+	return sdb, nil
+}
+
+// SchemaVersion is the current schema version, stored in PRAGMA user_version by RunMigrations
+const SchemaVersion = 12
+
+// addedColumns lists columns introduced after a table was first created.
+// RunMigrations adds them to databases created by older binaries.
+var addedColumns = []struct{ table, name, definition string }{
+	{"tokens", "client_ip", "TEXT"},
+	{"tokens", "user_agent", "TEXT"},
+	{"tokens", "subject", "TEXT"},
+	{"tokens", "name", "TEXT"},
+	{"tokens", "signature", "TEXT"},
+	{"tokens", "revoked_at", "INTEGER"},
+	{"tokens", "change_seq", "INTEGER NOT NULL DEFAULT 0"},
+	{"tokens", "labels", "TEXT"}, // JSON object, NULL when there are none
+}
+
+// rowSignature is the HMAC-SHA256 over a token row's immutable fields, stored in tokens.signature.
+// Fields are joined with '|', which can't appear in the jti or the timestamps.
+func rowSignature(key []byte, id string, issuedAt, expiresAt time.Time, subject string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s|%d|%d|%s", id, issuedAt.Unix(), expiresAt.Unix(), subject)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyRowSignature reports whether the stored signature matches the token, missing signatures don't
+func verifyRowSignature(key []byte, token *Token, signature sql.NullString) bool {
+	want := rowSignature(key, token.ID, token.IssuedAt, token.ExpiresAt, token.Subject)
+	return signature.Valid && hmac.Equal([]byte(signature.String), []byte(want))
+}
+
+// claimColumn returns the tokens column that stores a CLAIM_COLUMNS claim
+func claimColumn(claim string) string {
+	return "claim_" + claim
+}
+
+// validClaimColumn reports whether a claim name is safe to use in a column name
+func validClaimColumn(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// claimColumnValues extracts the CLAIM_COLUMNS claims of a token. Strings are stored as is,
+// other values (e.g. an aud array) as their JSON encoding.
+func claimColumnValues(claims jwt.MapClaims, names []string) map[string]string {
+	values := map[string]string{}
+	for _, name := range names {
+		switch v := claims[name].(type) {
+		case nil:
+		case string:
+			values[name] = v
+		default:
+			if b, err := json.Marshal(v); err == nil {
+				values[name] = string(b)
+			}
+		}
+	}
+	return values
+}
+
+// hasColumn reports whether the table has the given column
+func (s *SqliteDB) hasColumn(ctx context.Context, table, column string) (bool, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, fmt.Errorf("hasColumn: failed to query %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, fmt.Errorf("hasColumn: failed to scan row: %w", err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// CheckSchema returns ErrSchemaOutdated if migrations have not been applied to the database
+func (s *SqliteDB) CheckSchema(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("CheckSchema: failed to read schema version: %w", err)
+	}
+	if version < SchemaVersion {
+		return fmt.Errorf("schema version %d, expected %d: %w", version, SchemaVersion, ErrSchemaOutdated)
+	}
+
+	for _, col := range addedColumns {
+		ok, err := s.hasColumn(ctx, col.table, col.name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("missing column %s.%s: %w", col.table, col.name, ErrSchemaOutdated)
+		}
+	}
+
+	for _, claim := range s.claimColumns {
+		ok, err := s.hasColumn(ctx, "tokens", claimColumn(claim))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("missing column tokens.%s for CLAIM_COLUMNS: %w", claimColumn(claim), ErrSchemaOutdated)
+		}
+	}
+
+	return nil
+}
+
+// RunMigrations applies migrations to the database
+func (s *SqliteDB) RunMigrations(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	m1 := `CREATE TABLE IF NOT EXISTS tokens (
+		id          TEXT PRIMARY KEY,
+		is_revoked  INTEGER NOT NULL,
+		issued_at   TEXT NOT NULL,
+		expires_at  TEXT NOT NULL,
+		updated_at  TEXT NOT NULL,
+		client_ip   TEXT,
+		user_agent 	TEXT
+	);`
+
+	m2 := `CREATE TABLE IF NOT EXISTS token_usages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_id TEXT NOT NULL,
+		ts INTEGER NOT NULL,
+		client_ip   TEXT,
+		user_agent 	TEXT,
+		method TEXT,
+		status INTEGER,
+		FOREIGN KEY (token_id) REFERENCES tokens(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_usage_token_ts ON token_usages(token_id, ts);`
+
+	// Run migrations sequentially
+	if _, err := s.db.ExecContext(ctx, m1); err != nil {
+		return fmt.Errorf("failed to run migration m1: %w", err)
+	}
+
+	if _, err := s.db.ExecContext(ctx, m2); err != nil {
+		return fmt.Errorf("failed to run migration m2: %w", err)
+	}
+
+	// Bring tables created by older binaries up to date (m3)
+	for _, col := range addedColumns {
+		ok, err := s.hasColumn(ctx, col.table, col.name)
+		if err != nil {
+			return fmt.Errorf("failed to run migration m3: %w", err)
+		}
+		if ok {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.name, col.definition)
+		if _, err := s.db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to run migration m3: %w", err)
+		}
+	}
+
+	m4 := `CREATE INDEX IF NOT EXISTS idx_tokens_subject ON tokens(subject);`
+
+	if _, err := s.db.ExecContext(ctx, m4); err != nil {
+		return fmt.Errorf("failed to run migration m4: %w", err)
+	}
+
+	m5 := `CREATE INDEX IF NOT EXISTS idx_tokens_client_ip ON tokens(client_ip);`
+
+	if _, err := s.db.ExecContext(ctx, m5); err != nil {
+		return fmt.Errorf("failed to run migration m5: %w", err)
+	}
+
+	m6 := `CREATE TABLE IF NOT EXISTS used_nonces (
+		nonce      TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_used_nonces_expires_at ON used_nonces(expires_at);`
+
+	if _, err := s.db.ExecContext(ctx, m6); err != nil {
+		return fmt.Errorf("failed to run migration m6: %w", err)
+	}
+
+	// Expression index matching the CAST(issued_at AS INTEGER) range filters, issued_at is stored as text
+	m7 := `CREATE INDEX IF NOT EXISTS idx_tokens_issued_at ON tokens(CAST(issued_at AS INTEGER));`
+
+	if _, err := s.db.ExecContext(ctx, m7); err != nil {
+		return fmt.Errorf("failed to run migration m7: %w", err)
+	}
+
+	// Per-client issuance counts for CLIENT_ACCOUNTING, one row per client and hour
+	m8 := `CREATE TABLE IF NOT EXISTS client_usage (
+		client_id TEXT NOT NULL,
+		hour      INTEGER NOT NULL,
+		issued    INTEGER NOT NULL,
+		PRIMARY KEY (client_id, hour)
+	);
+	CREATE INDEX IF NOT EXISTS idx_client_usage_hour ON client_usage(hour);`
+
+	if _, err := s.db.ExecContext(ctx, m8); err != nil {
+		return fmt.Errorf("failed to run migration m8: %w", err)
+	}
+
+	// Revocations before revoked_at existed are dated by their last update, the best there is
+	m9 := `UPDATE tokens SET revoked_at = CAST(updated_at AS INTEGER) WHERE is_revoked = 1 AND revoked_at IS NULL;
+	CREATE INDEX IF NOT EXISTS idx_tokens_revoked_at ON tokens(revoked_at);`
+
+	if _, err := s.db.ExecContext(ctx, m9); err != nil {
+		return fmt.Errorf("failed to run migration m9: %w", err)
+	}
+
+	// Every insert or update of a token stamps it with the next value of a global counter,
+	// so TokensVersion sees changes that happen within the same second as the previous one.
+	// The triggers' own UPDATE doesn't fire them again, recursive_triggers is off.
+	m10 := `CREATE TABLE IF NOT EXISTS token_changes (seq INTEGER NOT NULL);
+	INSERT INTO token_changes (seq) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM token_changes);
+	CREATE TRIGGER IF NOT EXISTS tokens_change_seq_insert AFTER INSERT ON tokens BEGIN
+		UPDATE token_changes SET seq = seq + 1;
+		UPDATE tokens SET change_seq = (SELECT seq FROM token_changes) WHERE rowid = NEW.rowid;
+	END;
+	CREATE TRIGGER IF NOT EXISTS tokens_change_seq_update AFTER UPDATE ON tokens BEGIN
+		UPDATE token_changes SET seq = seq + 1;
+		UPDATE tokens SET change_seq = (SELECT seq FROM token_changes) WHERE rowid = NEW.rowid;
+	END;`
+
+	if _, err := s.db.ExecContext(ctx, m10); err != nil {
+		return fmt.Errorf("failed to run migration m10: %w", err)
+	}
+
+	// Columns for CLAIM_COLUMNS depend on the config, so they are added on demand like m3
+	for _, claim := range s.claimColumns {
+		column := claimColumn(claim)
+		ok, err := s.hasColumn(ctx, "tokens", column)
+		if err != nil {
+			return fmt.Errorf("failed to add claim column %s: %w", column, err)
+		}
+		if !ok {
+			if _, err := s.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE tokens ADD COLUMN %s TEXT", column)); err != nil {
+				return fmt.Errorf("failed to add claim column %s: %w", column, err)
+			}
+		}
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_tokens_%s ON tokens(%s)", column, column)); err != nil {
+			return fmt.Errorf("failed to index claim column %s: %w", column, err)
+		}
+	}
+
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+
+	return nil
+}
+
+// requestTimingKey is the context key of the per-request *requestTiming
+type requestTimingKey struct{}
+
+// requestTiming accumulates time spent in the database during a request
+type requestTiming struct {
+	db atomic.Int64 // nanoseconds
+}
+
+// addDBTime adds the time elapsed since start to the request timing in ctx, if any
+func addDBTime(ctx context.Context, start time.Time) {
+	if t, ok := ctx.Value(requestTimingKey{}).(*requestTiming); ok {
+		t.db.Add(int64(time.Since(start)))
+	}
+}
+
+// TestConnection tests the database connection with a timeout
+func (s *SqliteDB) TestConnection(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := s.db.PingContext(ctx); err != nil {
+		return err
+	}
+	return s.rdb.PingContext(ctx)
+}
+
+// ProbeWriteLock takes and releases the write lock, failing with SQLITE_BUSY while another process holds it
+func (s *SqliteDB) ProbeWriteLock(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "ROLLBACK")
+	return err
+}
+
+// isDatabaseLocked reports whether err means another connection holds the SQLite lock
+func isDatabaseLocked(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// retryWhileLocked runs fn until it succeeds or fails with something other than a locked database,
+// backing off for up to wait. If the file is still locked then, the error says what to check.
+func retryWhileLocked(path string, wait time.Duration, fn func() error) error {
+	deadline := time.Now().Add(wait)
+	backoff := 100 * time.Millisecond
+	for {
+		err := fn()
+		if !isDatabaseLocked(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("database file %s is still locked after %s, another process (a second instance?) is holding it: "+
+				"run one instance per file, or raise _busy_timeout (ms) in DATABASE_URI to wait out long writes: %w", path, wait, err)
+		}
+		log.Printf("Database file %s is locked by another process, retrying in %s", path, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 2*time.Second)
+	}
+}
+
+// DiskFreeBytes returns free disk space available on the filesystem holding the database file
+func (s *SqliteDB) DiskFreeBytes() (uint64, error) {
+	dir := filepath.Dir(s.path)
+	if s.path == "" || s.path == ":memory:" {
+		dir = "."
+	}
+	return diskFreeBytes(dir)
+}
+
+// diskFreeBytes returns free disk space available to unprivileged users on the filesystem holding dir
+func diskFreeBytes(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("DiskFreeBytes: statfs %s: %w", dir, err)
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// SizeBytes returns the size of the database pages, free pages included
+func (s *SqliteDB) SizeBytes(ctx context.Context) (int64, error) {
+	defer addDBTime(ctx, time.Now())
+
+	var size int64
+	query := "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()"
+	if err := s.db.QueryRowContext(ctx, query).Scan(&size); err != nil {
+		return 0, fmt.Errorf("SizeBytes: %w", err)
+	}
+	return size, nil
+}
+
+// Vacuum rebuilds the database file to return free pages to the filesystem.
+// It holds the single write connection for the whole run, blocking writers,
+// so it is meant for low-traffic windows.
+func (s *SqliteDB) Vacuum(ctx context.Context) error {
+	defer addDBTime(ctx, time.Now())
+
+	if _, err := s.db.ExecContext(ctx, "VACUUM"); err != nil {
+		return fmt.Errorf("Vacuum: %w", storageError(err))
+	}
+	return nil
+}
+
+// BackupTo writes a consistent copy of the database to path with VACUUM INTO, which reads
+// a single snapshot so concurrent writes, WAL included, don't tear the copy. path must not
+// exist or be an empty file. The copy is compacted, so it may be smaller than the database.
+// It needs the write connection, the read pool is read-only, so writers wait for it like for Vacuum.
+func (s *SqliteDB) BackupTo(ctx context.Context, path string) error {
+	defer addDBTime(ctx, time.Now())
+
+	if _, err := s.db.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("BackupTo: %w", storageError(err))
+	}
+	return nil
+}
+
+// CloseContext closes the database, waiting for active queries to finish or ctx to expire,
+// whichever comes first. Returns a ctx error if the connections had to be abandoned.
+func (s *SqliteDB) CloseContext(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Close()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("CloseContext: active queries did not finish: %w", ctx.Err())
+	}
+}
+
+// Close closes the database connection
+func (s *SqliteDB) Close() error {
+	if s.rdb != nil && s.rdb != s.db {
+		if err := s.rdb.Close(); err != nil {
+			return err
+		}
+	}
+	if s.db != nil {
+		return s.db.Close()
+	}
+	return nil
+}
+
+// parseTokenFromDb fills a Token struct from database row values
+func parseTokenFromDb(token *Token, isRevokedInt int, issuedAtStr, expiresAtStr, updatedAtStr string, clientIP, userAgent sql.NullString) error {
+	// Convert INTEGER to boolean
+	token.IsRevoked = isRevokedInt != 0
+
+	// Parse Unix timestamps to time.Time
+	issuedAtUnix, err := strconv.ParseInt(issuedAtStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse issued_at: %w", err)
+	}
+	token.IssuedAt = time.Unix(issuedAtUnix, 0)
+
+	expiresAtUnix, err := strconv.ParseInt(expiresAtStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse expires_at: %w", err)
+	}
+	token.ExpiresAt = time.Unix(expiresAtUnix, 0)
+
+	updatedAtUnix, err := strconv.ParseInt(updatedAtStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse updated_at: %w", err)
+	}
+	token.UpdatedAt = time.Unix(updatedAtUnix, 0)
+
+	// Set client_ip and user_agent
+	token.ClientIP = clientIP.String
+	token.UserAgent = userAgent.String
+
+	return nil
+}
+
+// tokenColumns is the column list read by scanToken
+const tokenColumns = "id, is_revoked, issued_at, expires_at, updated_at, client_ip, user_agent, subject, name, labels"
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanToken reads a row selected with tokenColumns, extra destinations are scanned after them
+func scanToken(row rowScanner, extra ...any) (*Token, error) {
+	var token Token
+	var issuedAtStr, expiresAtStr, updatedAtStr string
+	var isRevokedInt int
+	var clientIP, userAgent, subject, name, labels sql.NullString
+
+	dest := []any{&token.ID, &isRevokedInt, &issuedAtStr, &expiresAtStr, &updatedAtStr, &clientIP, &userAgent, &subject, &name, &labels}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	if err := parseTokenFromDb(&token, isRevokedInt, issuedAtStr, expiresAtStr, updatedAtStr, clientIP, userAgent); err != nil {
+		return nil, err
+	}
+	token.Subject = subject.String
+	token.Name = name.String
+	if labels.Valid {
+		if err := json.Unmarshal([]byte(labels.String), &token.Labels); err != nil {
+			return nil, fmt.Errorf("invalid labels of token %s: %w", token.ID, err)
+		}
+	}
+
+	return &token, nil
+}
+
+// TokenFilter narrows ListTokens, zero values match everything
+type TokenFilter struct {
+	Name      string     // case-insensitive substring of the token name
+	Subject   string     // exact sub match
+	ClientIP  string     // exact client_ip match
+	ClientNet *net.IPNet // client_ip within the CIDR range, checked after the query
+	UserAgent string     // case-insensitive substring of the user agent
+
+	IssuedAfter  time.Time // issued_at strictly after, ignored when zero
+	IssuedBefore time.Time // issued_at strictly before, ignored when zero
+
+	ExpiresAfter  time.Time // expires_at strictly after, ignored when zero
+	ExpiresBefore time.Time // expires_at at or before, ignored when zero
+	NotRevoked    bool
+
+	Claims map[string]string // exact match on CLAIM_COLUMNS columns, by claim name
+}
+
+// where builds the WHERE clause and its arguments for the filter
+func (f TokenFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+
+	if f.Name != "" {
+		conds = append(conds, `name LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(f.Name)+"%")
+	}
+	if f.Subject != "" {
+		conds = append(conds, "subject = ?")
+		args = append(args, f.Subject)
+	}
+	if f.ClientIP != "" {
+		conds = append(conds, "client_ip = ?")
+		args = append(args, f.ClientIP)
+	}
+	if f.UserAgent != "" {
+		conds = append(conds, `user_agent LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(f.UserAgent)+"%")
+	}
+	if !f.IssuedAfter.IsZero() {
+		conds = append(conds, "CAST(issued_at AS INTEGER) > ?")
+		args = append(args, f.IssuedAfter.Unix())
+	}
+	if !f.IssuedBefore.IsZero() {
+		conds = append(conds, "CAST(issued_at AS INTEGER) < ?")
+		args = append(args, f.IssuedBefore.Unix())
+	}
+	if !f.ExpiresAfter.IsZero() {
+		conds = append(conds, "CAST(expires_at AS INTEGER) > ?")
+		args = append(args, f.ExpiresAfter.Unix())
+	}
+	if !f.ExpiresBefore.IsZero() {
+		conds = append(conds, "CAST(expires_at AS INTEGER) <= ?")
+		args = append(args, f.ExpiresBefore.Unix())
+	}
+	if f.NotRevoked {
+		conds = append(conds, "is_revoked = 0")
+	}
+	for _, claim := range slices.Sorted(maps.Keys(f.Claims)) {
+		conds = append(conds, claimColumn(claim)+" = ?")
+		args = append(args, f.Claims[claim])
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// matchesNet reports whether the token's client IP lies within ClientNet, SQLite has no CIDR operator
+func (f TokenFilter) matchesNet(token *Token) bool {
+	if f.ClientNet == nil {
+		return true
+	}
+	ip := net.ParseIP(token.ClientIP)
+	return ip != nil && f.ClientNet.Contains(ip)
+}
+
+// likeEscaper escapes LIKE wildcards so user input matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// ListTokens returns the tokens matching the filter, oldest update first
+func (s *SqliteDB) ListTokens(ctx context.Context, filter TokenFilter) ([]Token, error) {
+	return s.listTokens(ctx, filter, "updated_at")
+}
+
+// TokensVersion returns a fingerprint of the tokens matching the filter that changes whenever
+// one of them is created, revoked, updated or deleted (row count, newest change_seq)
+func (s *SqliteDB) TokensVersion(ctx context.Context, filter TokenFilter) (_ string, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return "", err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	where, args := filter.where()
+	query := "SELECT COUNT(*), COALESCE(MAX(change_seq), 0) FROM tokens" + where
+
+	var count, seq int64
+	if err := s.rdb.QueryRowContext(ctx, query, args...).Scan(&count, &seq); err != nil {
+		return "", fmt.Errorf("TokensVersion: %w", err)
+	}
+	return fmt.Sprintf("%d-%d", count, seq), nil
+}
+
+// ListExpiringSoon returns the unrevoked tokens matching the filter that expire
+// within the given duration from now, soonest first
+func (s *SqliteDB) ListExpiringSoon(ctx context.Context, within time.Duration, filter TokenFilter) ([]Token, error) {
+	now := time.Now()
+	filter.ExpiresAfter = now
+	filter.ExpiresBefore = now.Add(within)
+	filter.NotRevoked = true
+	return s.listTokens(ctx, filter, "CAST(expires_at AS INTEGER)")
+}
+
+// listTokens runs the filtered token query with the given ORDER BY expression
+func (s *SqliteDB) listTokens(ctx context.Context, filter TokenFilter, orderBy string) (_ []Token, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	where, args := filter.where()
+	query := "SELECT " + tokenColumns + " FROM tokens" + where + " ORDER BY " + orderBy
+
+	rows, err := s.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan token row: %w", err)
+		}
+		if !filter.matchesNet(token) {
+			continue
+		}
+
+		tokens = append(tokens, *token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating token rows: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// CreateToken creates a new token record in the database
+func (s *SqliteDB) CreateToken(ctx context.Context, token Token) (err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	return s.insertToken(ctx, s.db, token)
+}
+
+// RotateNamedToken creates the token and revokes the subject's other active tokens with the same
+// name in one transaction, so there is never a moment with two or none. It returns the revoked ids.
+func (s *SqliteDB) RotateNamedToken(ctx context.Context, token Token) (_ []string, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("RotateNamedToken: failed to begin: %w", storageError(err))
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE tokens
+	SET is_revoked = 1, revoked_at = ?, updated_at = ?
+	WHERE subject = ? AND name = ? AND is_revoked = 0 AND CAST(expires_at AS INTEGER) > ?
+	RETURNING id;`
+
+	now := time.Now().Unix()
+	rows, err := tx.QueryContext(ctx, query, now, now, token.Subject, token.Name, now)
+	if err != nil {
+		return nil, fmt.Errorf("RotateNamedToken: failed to revoke: %w", storageError(err))
+	}
+	var revoked []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("RotateNamedToken: failed to scan row: %w", err)
+		}
+		revoked = append(revoked, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("RotateNamedToken: error iterating rows: %w", storageError(err))
+	}
+
+	if err := s.insertToken(ctx, tx, token); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("RotateNamedToken: failed to commit: %w", storageError(err))
+	}
+	return revoked, nil
+}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// insertToken writes the token row through ex, the database or a transaction
+func (s *SqliteDB) insertToken(ctx context.Context, ex execer, token Token) error {
+	columns := "id, is_revoked, issued_at, expires_at, updated_at, client_ip, user_agent, subject, name"
+	placeholders := "?, ?, ?, ?, ?, ?, ?, ?, ?"
+
+	isRevokedInt := 0
+	if token.IsRevoked {
+		isRevokedInt = 1
+	}
+
+	args := []any{
+		token.ID,
+		isRevokedInt,
+		token.IssuedAt.Unix(),
+		token.ExpiresAt.Unix(),
+		token.UpdatedAt.Unix(),
+		token.ClientIP,
+		token.UserAgent,
+		sql.NullString{String: token.Subject, Valid: token.Subject != ""},
+		sql.NullString{String: token.Name, Valid: token.Name != ""},
+	}
+	for _, claim := range s.claimColumns {
+		value, ok := token.ClaimValues[claim]
+		columns += ", " + claimColumn(claim)
+		placeholders += ", ?"
+		args = append(args, sql.NullString{String: value, Valid: ok})
+	}
+	if s.rowKey != nil {
+		columns += ", signature"
+		placeholders += ", ?"
+		args = append(args, rowSignature(s.rowKey, token.ID, token.IssuedAt, token.ExpiresAt, token.Subject))
+	}
+
+	query := fmt.Sprintf("INSERT INTO tokens (%s) VALUES (%s);", columns, placeholders)
+
+	_, err := ex.ExecContext(ctx, query, args...)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return fmt.Errorf("CreateToken: %s: %w", token.ID, ErrTokenExists)
+		}
+		return fmt.Errorf("CreateToken: failed to insert: %w", storageError(err))
+	}
+	return nil
+}
+
+// GetTokenByID retrieves a token by its ID from the database
+func (s *SqliteDB) GetTokenByID(ctx context.Context, tokenID string) (_ *Token, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := "SELECT " + tokenColumns + ", signature FROM tokens WHERE id = ?"
+
+	var signature sql.NullString
+	token, err := scanToken(s.rdb.QueryRowContext(ctx, query, tokenID), &signature)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("GetTokenByID: %s: %w", tokenID, ErrTokenNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query token: %w", err)
+	}
+	if s.rowKey != nil && !verifyRowSignature(s.rowKey, token, signature) {
+		return nil, fmt.Errorf("GetTokenByID: %s: %w", tokenID, ErrTokenTampered)
+	}
+
+	return token, nil
+}
+
+// VerifyIntegrity checks every token row against its signature and returns the ids that don't match.
+// Rows without a signature, created before ROW_HMAC_KEY was set, are reported too.
+func (s *SqliteDB) VerifyIntegrity(ctx context.Context) (_ []string, err error) {
+	defer addDBTime(ctx, time.Now())
+	if s.rowKey == nil {
+		return nil, fmt.Errorf("VerifyIntegrity: ROW_HMAC_KEY is not set")
+	}
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	rows, err := s.rdb.QueryContext(ctx, "SELECT "+tokenColumns+", signature FROM tokens ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("VerifyIntegrity: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	mismatched := []string{}
+	for rows.Next() {
+		var signature sql.NullString
+		token, err := scanToken(rows, &signature)
+		if err != nil {
+			return nil, fmt.Errorf("VerifyIntegrity: failed to scan row: %w", err)
+		}
+		if !verifyRowSignature(s.rowKey, token, signature) {
+			mismatched = append(mismatched, token.ID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("VerifyIntegrity: error iterating rows: %w", err)
+	}
+	return mismatched, nil
+}
+
+// CreateTokenUsage creates a new token usage record in the database
+func (s *SqliteDB) CreateTokenUsage(ctx context.Context, tokenID string, ts int64, clientIP, userAgent, method string, status int) (err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	INSERT INTO token_usages (
+	    token_id, ts, client_ip, user_agent, method, status
+	) VALUES (?, ?, ?, ?, ?, ?);
+	`
+
+	_, err = s.db.ExecContext(
+		ctx,
+		query,
+		tokenID,
+		ts,
+		clientIP,
+		userAgent,
+		method,
+		status,
+	)
+	if err != nil {
+		return fmt.Errorf("CreateTokenUsage: failed to insert: %w", storageError(err))
+	}
+	return nil
+}
+
+// UseNonce records a one-time token nonce, remembered until expiresAt.
+// Returns ErrNonceUsed if it was already recorded. The insert is a single statement,
+// so concurrent verifications of the same token can't both succeed.
+func (s *SqliteDB) UseNonce(ctx context.Context, nonce string, expiresAt time.Time) (err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `INSERT INTO used_nonces (nonce, expires_at) VALUES (?, ?) ON CONFLICT(nonce) DO NOTHING;`
+
+	res, err := s.db.ExecContext(ctx, query, nonce, expiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("UseNonce: failed to insert: %w", storageError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("UseNonce: failed to get affected rows: %w", err)
+	}
+	if n == 0 {
+		return ErrNonceUsed
+	}
+	return nil
+}
+
+// DeleteExpiredNonces removes nonces whose tokens have expired and returns how many were removed
+func (s *SqliteDB) DeleteExpiredNonces(ctx context.Context, now time.Time) (_ int64, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return 0, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM used_nonces WHERE expires_at <= ?;`, now.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("DeleteExpiredNonces: failed to delete: %w", storageError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DeleteExpiredNonces: failed to get affected rows: %w", err)
+	}
+	return n, nil
+}
+
+// lastUsedExpr is the unix time a token was last used, its issuance when it never was.
+// Issuance is recorded as a usage too, the fallback covers tokens whose usages were lost.
+const lastUsedExpr = `COALESCE((SELECT MAX(ts) FROM token_usages WHERE token_usages.token_id = tokens.id), CAST(issued_at AS INTEGER))`
+
+// LastUsedAt returns when the token was last used, see lastUsedExpr
+func (s *SqliteDB) LastUsedAt(ctx context.Context, id string) (_ time.Time, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	var ts int64
+	err = s.rdb.QueryRowContext(ctx, `SELECT `+lastUsedExpr+` FROM tokens WHERE id = ?;`, id).Scan(&ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, fmt.Errorf("LastUsedAt: %s: %w", id, ErrTokenNotFound)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("LastUsedAt: %w", storageError(err))
+	}
+	return time.Unix(ts, 0), nil
+}
+
+// RevokeIdleTokens revokes unexpired tokens last used before idleSince and returns them, ID and subject set
+func (s *SqliteDB) RevokeIdleTokens(ctx context.Context, now, idleSince time.Time) (revoked []Token, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	UPDATE tokens
+	SET is_revoked = 1, revoked_at = ?, updated_at = ?
+	WHERE is_revoked = 0 AND CAST(expires_at AS INTEGER) > ? AND ` + lastUsedExpr + ` < ?
+	RETURNING id, subject;`
+
+	rows, err := s.db.QueryContext(ctx, query, now.Unix(), now.Unix(), now.Unix(), idleSince.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("RevokeIdleTokens: failed to update: %w", storageError(err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token Token
+		var subject sql.NullString
+		if err := rows.Scan(&token.ID, &subject); err != nil {
+			return nil, fmt.Errorf("RevokeIdleTokens: failed to scan row: %w", err)
+		}
+		token.Subject = subject.String
+		token.IsRevoked = true
+		revoked = append(revoked, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("RevokeIdleTokens: error iterating rows: %w", storageError(err))
+	}
+	return revoked, nil
+}
+
+// CountTokens returns the number of token rows, revoked and expired ones included
+func (s *SqliteDB) CountTokens(ctx context.Context) (_ int64, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return 0, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	var n int64
+	if err := s.rdb.QueryRowContext(ctx, `SELECT COUNT(*) FROM tokens;`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("CountTokens: %w", storageError(err))
+	}
+	return n, nil
+}
+
+// DeleteExpiredTokens removes tokens that expired before now, with their usage records,
+// and returns how many were removed. Expired tokens fail verification on exp anyway.
+func (s *SqliteDB) DeleteExpiredTokens(ctx context.Context, now time.Time) (_ int64, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return 0, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM tokens WHERE CAST(expires_at AS INTEGER) <= ?;`, now.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("DeleteExpiredTokens: failed to delete: %w", storageError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DeleteExpiredTokens: failed to get affected rows: %w", err)
+	}
+	return n, nil
+}
+
+// RevokeToken marks a token as revoked in the database and returns the updated token
+func (s *SqliteDB) RevokeToken(ctx context.Context, tokenID string) (_ *Token, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	UPDATE tokens 
+	SET is_revoked = 1, revoked_at = COALESCE(revoked_at, ?), updated_at = ?
+	WHERE id = ?
+	RETURNING ` + tokenColumns + `;
+	`
+
+	now := time.Now()
+	token, err := scanToken(s.db.QueryRowContext(
+		ctx,
+		query,
+		now.Unix(),
+		now.Unix(),
+		tokenID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("RevokeToken: %s: %w", tokenID, ErrTokenNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("RevokeToken: failed to update: %w", storageError(err))
+	}
+
+	return token, nil
+}
+
+// maxSQLiteParams is SQLITE_MAX_VARIABLE_NUMBER of SQLite builds before 3.32, the lowest we may run on
+const maxSQLiteParams = 999
+
+// TokenState is a token row with when it was last used, as read by GetTokensByIDs
+type TokenState struct {
+	Token    *Token
+	LastUsed time.Time // see lastUsedExpr
+	Tampered bool      // the row fails the ROW_HMAC_KEY check
+}
+
+// GetTokensByIDs reads the given tokens in one query, leaving out ids without a row.
+// Callers keep the ids under maxSQLiteParams.
+func (s *SqliteDB) GetTokensByIDs(ctx context.Context, ids []string) (_ map[string]TokenState, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	states := make(map[string]TokenState, len(ids))
+	if len(ids) == 0 {
+		return states, nil
+	}
+
+	query := "SELECT " + tokenColumns + ", signature, " + lastUsedExpr + " FROM tokens WHERE id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := s.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("GetTokensByIDs: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var signature sql.NullString
+		var lastUsed int64
+		token, err := scanToken(rows, &signature, &lastUsed)
+		if err != nil {
+			return nil, fmt.Errorf("GetTokensByIDs: failed to scan row: %w", err)
+		}
+		states[token.ID] = TokenState{
+			Token:    token,
+			LastUsed: time.Unix(lastUsed, 0),
+			Tampered: s.rowKey != nil && !verifyRowSignature(s.rowKey, token, signature),
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetTokensByIDs: error iterating rows: %w", err)
+	}
+	return states, nil
+}
+
+// CreateTokenUsages records one use of each of the given tokens in a single statement.
+// Callers keep the ids under maxSQLiteParams/6.
+func (s *SqliteDB) CreateTokenUsages(ctx context.Context, tokenIDs []string, ts int64, clientIP, userAgent, method string, status int) (err error) {
+	defer addDBTime(ctx, time.Now())
+	if len(tokenIDs) == 0 {
+		return nil
+	}
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	INSERT INTO token_usages (
 	    token_id, ts, client_ip, user_agent, method, status
-	) VALUES (?, ?, ?, ?, ?, ?);
+	) VALUES (?, ?, ?, ?, ?, ?)` + strings.Repeat(", (?, ?, ?, ?, ?, ?)", len(tokenIDs)-1)
+
+	args := make([]any, 0, 6*len(tokenIDs))
+	for _, id := range tokenIDs {
+		args = append(args, id, ts, clientIP, userAgent, method, status)
+	}
+
+	if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("CreateTokenUsages: failed to insert: %w", storageError(err))
+	}
+	return nil
+}
+
+// RevokeTokens revokes the given tokens in one transaction, chunking the IN list under the
+// parameter limit. It returns the rows it revoked (id and subject only), the ids that were
+// revoked already and the ids that don't exist.
+func (s *SqliteDB) RevokeTokens(ctx context.Context, ids []string) (revoked []Token, alreadyRevoked, missing []string, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("RevokeTokens: failed to begin: %w", storageError(err))
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	found := make(map[string]bool, len(ids))
+	for chunk := range slices.Chunk(ids, maxSQLiteParams-2) {
+		in := "(?" + strings.Repeat(", ?", len(chunk)-1) + ")"
+		args := make([]any, 0, len(chunk))
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+
+		query := `
+		UPDATE tokens
+		SET is_revoked = 1, revoked_at = ?, updated_at = ?
+		WHERE is_revoked = 0 AND id IN ` + in + `
+		RETURNING id, subject;`
+
+		rows, err := tx.QueryContext(ctx, query, append([]any{now, now}, args...)...)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("RevokeTokens: failed to update: %w", storageError(err))
+		}
+		for rows.Next() {
+			var token Token
+			var subject sql.NullString
+			if err := rows.Scan(&token.ID, &subject); err != nil {
+				rows.Close()
+				return nil, nil, nil, fmt.Errorf("RevokeTokens: failed to scan row: %w", err)
+			}
+			token.Subject = subject.String
+			token.IsRevoked = true
+			found[token.ID] = true
+			revoked = append(revoked, token)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, nil, fmt.Errorf("RevokeTokens: error iterating rows: %w", storageError(err))
+		}
+
+		// What the update skipped exists revoked already, or not at all
+		rows, err = tx.QueryContext(ctx, "SELECT id FROM tokens WHERE is_revoked = 1 AND id IN "+in+";", args...)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("RevokeTokens: failed to query: %w", storageError(err))
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, nil, nil, fmt.Errorf("RevokeTokens: failed to scan row: %w", err)
+			}
+			if !found[id] {
+				found[id] = true
+				alreadyRevoked = append(alreadyRevoked, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, nil, fmt.Errorf("RevokeTokens: error iterating rows: %w", storageError(err))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, nil, fmt.Errorf("RevokeTokens: failed to commit: %w", storageError(err))
+	}
+
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	return revoked, alreadyRevoked, missing, nil
+}
+
+// ExtendTokenExpiry moves an active token's expires_at from one value to a later one, re-signing
+// the row. It reports false, changing nothing, when expires_at no longer holds from.
+func (s *SqliteDB) ExtendTokenExpiry(ctx context.Context, token Token, from, to time.Time) (_ bool, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return false, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	var signature sql.NullString
+	if s.rowKey != nil {
+		signature = sql.NullString{String: rowSignature(s.rowKey, token.ID, token.IssuedAt, to, token.Subject), Valid: true}
+	}
+
+	query := `
+	UPDATE tokens
+	SET expires_at = ?, updated_at = ?, signature = CASE WHEN ? THEN ? ELSE signature END
+	WHERE id = ? AND is_revoked = 0 AND CAST(expires_at AS INTEGER) = ?;`
+
+	res, err := s.db.ExecContext(ctx, query, to.Unix(), time.Now().Unix(), signature.Valid, signature, token.ID, from.Unix())
+	if err != nil {
+		return false, fmt.Errorf("ExtendTokenExpiry: failed to update: %w", storageError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("ExtendTokenExpiry: failed to get rows affected: %w", err)
+	}
+	return n == 1, nil
+}
+
+// CountIssuedBySubject returns how many tokens each subject was issued since the given time,
+// busiest first, limited to the top entries. Anonymous tokens are not counted.
+func (s *SqliteDB) CountIssuedBySubject(ctx context.Context, since time.Time, limit int) (_ []SubjectIssuance, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	SELECT subject, COUNT(*) AS issued
+	FROM tokens
+	WHERE subject IS NOT NULL AND CAST(issued_at AS INTEGER) >= ?
+	GROUP BY subject
+	ORDER BY issued DESC, subject
+	LIMIT ?`
+
+	rows, err := s.rdb.QueryContext(ctx, query, since.Unix(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("CountIssuedBySubject: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := []SubjectIssuance{}
+	for rows.Next() {
+		var c SubjectIssuance
+		if err := rows.Scan(&c.Subject, &c.Issued); err != nil {
+			return nil, fmt.Errorf("CountIssuedBySubject: failed to scan row: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("CountIssuedBySubject: error iterating rows: %w", err)
+	}
+	return counts, nil
+}
+
+// CountIssuedByBucket counts tokens issued since the given time per bucket of the given width,
+// aligned to the Unix epoch (so to UTC days). Buckets without tokens are left out.
+func (s *SqliteDB) CountIssuedByBucket(ctx context.Context, since time.Time, width time.Duration) (_ map[int64]int64, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	SELECT CAST(issued_at AS INTEGER) / ? * ? AS bucket, COUNT(*)
+	FROM tokens
+	WHERE CAST(issued_at AS INTEGER) >= ?
+	GROUP BY bucket`
+
+	sec := int64(width / time.Second)
+	rows, err := s.rdb.QueryContext(ctx, query, sec, sec, since.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("CountIssuedByBucket: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[int64]int64{}
+	for rows.Next() {
+		var bucket, issued int64
+		if err := rows.Scan(&bucket, &issued); err != nil {
+			return nil, fmt.Errorf("CountIssuedByBucket: failed to scan row: %w", err)
+		}
+		counts[bucket] = issued
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("CountIssuedByBucket: error iterating rows: %w", err)
+	}
+	return counts, nil
+}
+
+// AddClientUsage adds the given issuance counts to client_usage in one transaction
+func (s *SqliteDB) AddClientUsage(ctx context.Context, counts map[usageKey]int64) (err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("AddClientUsage: failed to begin transaction: %w", storageError(err))
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO client_usage (client_id, hour, issued) VALUES (?, ?, ?)
+	ON CONFLICT(client_id, hour) DO UPDATE SET issued = issued + excluded.issued`
+
+	for key, n := range counts {
+		if _, err := tx.ExecContext(ctx, query, key.ClientID, key.Hour, n); err != nil {
+			return fmt.Errorf("AddClientUsage: failed to add usage: %w", storageError(err))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("AddClientUsage: failed to commit: %w", storageError(err))
+	}
+	return nil
+}
+
+// CountIssuedByClient sums client_usage per client over the hours in [since, until), busiest first
+func (s *SqliteDB) CountIssuedByClient(ctx context.Context, since, until time.Time) (_ []ClientUsage, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	SELECT client_id, SUM(issued) AS issued
+	FROM client_usage
+	WHERE hour >= ? AND hour < ?
+	GROUP BY client_id
+	ORDER BY issued DESC, client_id`
+
+	rows, err := s.rdb.QueryContext(ctx, query, since.Unix(), until.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("CountIssuedByClient: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	clients := []ClientUsage{}
+	for rows.Next() {
+		var c ClientUsage
+		if err := rows.Scan(&c.ClientID, &c.Issued); err != nil {
+			return nil, fmt.Errorf("CountIssuedByClient: failed to scan row: %w", err)
+		}
+		clients = append(clients, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("CountIssuedByClient: error iterating rows: %w", err)
+	}
+	return clients, nil
+}
+
+// UpdateTokenMeta sets the token's operator metadata, nil fields are left unchanged
+func (s *SqliteDB) UpdateTokenMeta(ctx context.Context, id string, meta TokenMeta) (err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	UPDATE tokens
+	SET name = CASE WHEN ? THEN ? ELSE name END,
+		labels = CASE WHEN ? THEN ? ELSE labels END,
+		updated_at = ?
+	WHERE id = ?;
 	`
 
-	_, err := s.db.ExecContext(
-		ctx,
-		query,
-		tokenID,
-		ts,
-		clientIP,
-		userAgent,
-		method,
-		status,
-	)
+	var name sql.NullString
+	if meta.Name != nil {
+		name = sql.NullString{String: *meta.Name, Valid: *meta.Name != ""}
+	}
+	var labels sql.NullString
+	if len(meta.Labels) > 0 {
+		data, err := json.Marshal(meta.Labels)
+		if err != nil {
+			return fmt.Errorf("UpdateTokenMeta: failed to encode labels: %w", err)
+		}
+		labels = sql.NullString{String: string(data), Valid: true}
+	}
+
+	res, err := s.db.ExecContext(ctx, query, meta.Name != nil, name, meta.Labels != nil, labels, time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("UpdateTokenMeta: failed to update: %w", storageError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("UpdateTokenMeta: failed to get affected rows: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("UpdateTokenMeta: %s: %w", id, ErrTokenNotFound)
+	}
+	return nil
+}
+
+// ListSessions returns unexpired, unrevoked tokens of a subject with the time each was last used
+func (s *SqliteDB) ListSessions(ctx context.Context, subject string, now time.Time) (_ []Session, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	SELECT ` + tokenColumns + `,
+		(SELECT MAX(ts) FROM token_usages WHERE token_usages.token_id = tokens.id)
+	FROM tokens
+	WHERE subject = ? AND is_revoked = 0 AND CAST(expires_at AS INTEGER) > ?
+	ORDER BY CAST(issued_at AS INTEGER) DESC`
+
+	rows, err := s.rdb.QueryContext(ctx, query, subject, now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("ListSessions: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var lastUsed sql.NullInt64
+		token, err := scanToken(rows, &lastUsed)
+		if err != nil {
+			return nil, fmt.Errorf("ListSessions: failed to scan row: %w", err)
+		}
+
+		session := Session{Token: *token}
+		if lastUsed.Valid {
+			t := time.Unix(lastUsed.Int64, 0)
+			session.LastUsedAt = &t
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ListSessions: row iteration error: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// ListRevoked returns ids of tokens revoked at or after since, ordered by revocation time.
+// revoked_at is set once, metadata updates and extensions bump only updated_at.
+func (s *SqliteDB) ListRevoked(ctx context.Context, since time.Time) (_ []string, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	SELECT id
+	FROM tokens
+	WHERE is_revoked = 1 AND revoked_at >= ?
+	ORDER BY revoked_at, id`
+
+	rows, err := s.rdb.QueryContext(ctx, query, since.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("ListRevoked: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("ListRevoked: failed to scan row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ListRevoked: row iteration error: %w", err)
+	}
+
+	return ids, nil
+}
+
+// ListTokenUsage returns usage events for a given token ID ordered by timestamp descending
+func (s *SqliteDB) ListTokenUsage(ctx context.Context, tokenID string) (_ []TokenUsage, err error) {
+	defer addDBTime(ctx, time.Now())
+	ticket, err := s.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer s.breaker.Record(ticket, &err)
+
+	query := `
+	SELECT id, token_id, ts, client_ip, user_agent, method, status
+	FROM token_usages
+	WHERE token_id = ?
+	ORDER BY ts DESC`
+
+	rows, err := s.rdb.QueryContext(ctx, query, tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("ListTokenUsage: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	usages := []TokenUsage{}
+	for rows.Next() {
+		var usage TokenUsage
+		var tsInt int64
+		var clientIP, userAgent, method sql.NullString
+
+		if err := rows.Scan(&usage.ID, &usage.TokenID, &tsInt, &clientIP, &userAgent, &method, &usage.Status); err != nil {
+			return nil, fmt.Errorf("ListTokenUsage: failed to scan row: %w", err)
+		}
+
+		usage.TS = time.Unix(tsInt, 0)
+		usage.ClientIP = clientIP.String
+		usage.UserAgent = userAgent.String
+		usage.Method = method.String
+
+		usages = append(usages, usage)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ListTokenUsage: row iteration error: %w", err)
+	}
+
+	return usages, nil
+}
+
+// --- CIRCUIT BREAKER ---
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// circuitBreaker fails store calls fast while the database is failing.
+// It opens after threshold consecutive failures, and after the cooldown lets a single
+// probe call through: success closes it, failure opens it for another cooldown.
+// A nil breaker lets every call through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu         sync.Mutex
+	state      string
+	generation uint64 // bumped on every state change
+	failures   int
+	openedAt   time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold == 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+// breakerTicket is handed out by Allow and passed back to Record. Outcomes of calls admitted
+// before the last state change are stale: a slow success from before the breaker opened
+// says nothing about the database now.
+type breakerTicket struct {
+	generation uint64
+}
+
+// breakerOpenError is returned by Allow while the breaker is open
+type breakerOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e breakerOpenError) Error() string {
+	return fmt.Sprintf("%v, retry in %s", ErrDatabaseUnavailable, e.retryAfter.Round(time.Second))
+}
+
+func (e breakerOpenError) Unwrap() error { return ErrDatabaseUnavailable }
+
+// setState moves the breaker to state, invalidating the tickets of calls still in flight
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	b.generation++
+}
+
+// Allow returns a breakerOpenError if the call must not reach the database
+func (b *circuitBreaker) Allow() (breakerTicket, error) {
+	if b == nil {
+		return breakerTicket{}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			return breakerTicket{}, breakerOpenError{retryAfter: wait}
+		}
+		b.setState(BreakerHalfOpen) // this call is the probe
+		log.Printf("Circuit breaker, half-open, probing the database")
+	case BreakerHalfOpen:
+		return breakerTicket{}, breakerOpenError{retryAfter: time.Second} // probe in flight
+	}
+	return breakerTicket{generation: b.generation}, nil
+}
+
+// Record updates the breaker with the outcome of an allowed call, deferred with the call's named error
+func (b *circuitBreaker) Record(ticket breakerTicket, errp *error) {
+	if b == nil {
+		return
+	}
+	err := *errp
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ticket.generation != b.generation {
+		return
+	}
+
+	// A cancelled or timed out caller tells nothing either way. A probe that ends so
+	// reopens the breaker as it was, so the next call probes again right away.
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		if b.state == BreakerHalfOpen {
+			b.setState(BreakerOpen)
+		}
+		return
+	}
+
+	failed := isDatabaseFailure(err)
+	switch {
+	case !failed && b.state == BreakerHalfOpen:
+		log.Printf("Circuit breaker, closed, database recovered")
+		b.setState(BreakerClosed)
+		b.failures = 0
+	case !failed:
+		b.failures = 0
+	case b.state == BreakerHalfOpen:
+		b.setState(BreakerOpen)
+		b.openedAt = time.Now()
+		log.Printf("Circuit breaker, probe failed, open for %s: %v", b.cooldown, err)
+	case b.state == BreakerClosed:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.setState(BreakerOpen)
+			b.openedAt = time.Now()
+			log.Printf("Circuit breaker, open for %s after %d consecutive failures: %v", b.cooldown, b.failures, err)
+		}
+	}
+}
+
+// State returns the current breaker state, closed for a nil breaker
+func (b *circuitBreaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// isDatabaseFailure reports whether err means the database is failing. Lookups that
+// find nothing, conflicts, a full or read-only disk and cancelled or timed out requests don't count.
+func isDatabaseFailure(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrTokenNotFound),
+		errors.Is(err, ErrTokenExists),
+		errors.Is(err, ErrNonceUsed),
+		errors.Is(err, ErrTokenTampered),
+		errors.Is(err, ErrTokenIdle),
+		errors.Is(err, ErrStorageFull),
+		errors.Is(err, ErrStorageReadOnly),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
+
+// --- SECRETS ---
+
+// Tenant is an issuer with its own signing secret in multi-tenant mode
+type Tenant struct {
+	Issuer string // iss of the tenant's tokens
+	Secret []byte
+}
+
+// validTenantName reports whether name is usable as a kid and in JWT_TENANT_<NAME>_* variables
+func validTenantName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// SecretProvider supplies the HMAC signing secret
+type SecretProvider interface {
+	Secret() ([]byte, error)
+}
+
+// EnvSecretProvider serves a secret read from the environment at config load
+type EnvSecretProvider struct {
+	secret []byte
+}
+
+// NewEnvSecretProvider creates a provider for a fixed secret value
+func NewEnvSecretProvider(secret string) *EnvSecretProvider {
+	return &EnvSecretProvider{secret: []byte(secret)}
+}
+
+// Secret returns the configured secret
+func (p *EnvSecretProvider) Secret() ([]byte, error) {
+	if len(p.secret) == 0 {
+		return nil, fmt.Errorf("empty secret")
+	}
+	return p.secret, nil
+}
+
+// FileSecretProvider reads the secret from a mounted file (e.g. Docker/K8s secrets in /run/secrets)
+// and re-reads it when the file changes, checking at most once per fileSecretCheckInterval
+type FileSecretProvider struct {
+	path string
+
+	mu        sync.Mutex
+	secret    []byte
+	modTime   time.Time
+	size      int64
+	checkedAt time.Time
+}
+
+const fileSecretCheckInterval = time.Second
+
+// NewFileSecretProvider creates a provider reading the secret from path
+func NewFileSecretProvider(path string) *FileSecretProvider {
+	return &FileSecretProvider{path: path}
+}
+
+// Secret returns the file content without trailing newlines, re-reading it if the file changed
+func (p *FileSecretProvider) Secret() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.secret != nil && now.Sub(p.checkedAt) < fileSecretCheckInterval {
+		return p.secret, nil
+	}
+	p.checkedAt = now
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("FileSecretProvider: %w", err)
+	}
+	if p.secret != nil && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return p.secret, nil
+	}
+
+	b, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("FileSecretProvider: %w", err)
+	}
+	secret := []byte(strings.TrimRight(string(b), "\r\n"))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("FileSecretProvider: %s is empty", p.path)
+	}
+
+	if p.secret != nil {
+		log.Printf("FileSecretProvider, reloaded secret from %s", p.path)
+	}
+	p.secret, p.modTime, p.size = secret, info.ModTime(), info.Size()
+	return p.secret, nil
+}
+
+// --- ENCRYPTION ---
+
+// Encrypted tokens use direct key agreement and AES-256-GCM with the signed JWT as content
+// (RFC 7516, RFC 7519 section 5.2). Decryption accepts exactly these algorithms.
+var (
+	jweKeyAlgorithms     = []jose.KeyAlgorithm{jose.DIRECT}
+	jweContentEncryption = []jose.ContentEncryption{jose.A256GCM}
+)
+
+// encryptJWE wraps a signed token into a compact JWE
+func encryptJWE(signed string, key []byte) (string, error) {
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.DIRECT, Key: key},
+		(&jose.EncrypterOptions{}).WithContentType("JWT"))
+	if err != nil {
+		return "", fmt.Errorf("encryptJWE: %w", err)
+	}
+	jwe, err := encrypter.Encrypt([]byte(signed))
+	if err != nil {
+		return "", fmt.Errorf("encryptJWE: %w", err)
+	}
+	return jwe.CompactSerialize()
+}
+
+// decryptJWE unwraps a compact JWE produced by encryptJWE, returning the nested signed token.
+// Errors never carry token bytes, they end up in logs.
+func decryptJWE(token string, key []byte) (string, error) {
+	jwe, err := jose.ParseEncryptedCompact(token, jweKeyAlgorithms, jweContentEncryption)
+	if err != nil {
+		return "", fmt.Errorf("%w: not a compact dir A256GCM JWE", ErrTokenUndecryptable)
+	}
+	plaintext, err := jwe.Decrypt(key)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTokenUndecryptable, err)
+	}
+	return string(plaintext), nil
+}
+
+// --- PASETO ---
+
+// pasetoV4Public prefixes v4.public tokens, telling them apart from JWTs and JWEs
+const pasetoV4Public = "v4.public."
+
+// pasetoTimeClaims are NumericDates in a JWT and RFC 3339 strings in a PASETO
+var pasetoTimeClaims = []string{"exp", "nbf", "iat"}
+
+// pae is the pre-authentication encoding that PASETO signs: the piece count,
+// then each piece prefixed with its length, all as little-endian 64-bit integers
+func pae(pieces ...[]byte) []byte {
+	buf := binary.LittleEndian.AppendUint64(nil, uint64(len(pieces)))
+	for _, piece := range pieces {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(len(piece)))
+		buf = append(buf, piece...)
+	}
+	return buf
+}
+
+// signPaseto encodes claims as a PASETO v4.public token, without footer or implicit assertion
+func signPaseto(claims jwt.MapClaims, key ed25519.PrivateKey) (string, error) {
+	payload := maps.Clone(claims)
+	for _, name := range pasetoTimeClaims {
+		if _, ok := payload[name]; !ok {
+			continue
+		}
+		sec, err := claimInt64(payload, name)
+		if err != nil {
+			return "", fmt.Errorf("signPaseto: %w", err)
+		}
+		payload[name] = time.Unix(sec, 0).UTC().Format(time.RFC3339)
+	}
+	message, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("signPaseto: %w", err)
+	}
+
+	sig := ed25519.Sign(key, pae([]byte(pasetoV4Public), message, nil, nil))
+	return pasetoV4Public + base64.RawURLEncoding.EncodeToString(append(message, sig...)), nil
+}
+
+// parsePaseto verifies a PASETO v4.public token and returns its claims with the time claims
+// converted back to NumericDates, so the checks shared with JWTs apply unchanged.
+// A footer is covered by the signature but otherwise ignored.
+func parsePaseto(tokenString string, key ed25519.PrivateKey) (jwt.MapClaims, error) {
+	if key == nil {
+		return nil, jwt.NewValidationError("PASETO tokens are not accepted, PASETO_SECRET_KEY is not set", jwt.ValidationErrorUnverifiable)
+	}
+	body, footerStr, _ := strings.Cut(strings.TrimPrefix(tokenString, pasetoV4Public), ".")
+	signed, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil || len(signed) < ed25519.SignatureSize {
+		return nil, jwt.NewValidationError("malformed PASETO payload", jwt.ValidationErrorMalformed)
+	}
+	footer, err := base64.RawURLEncoding.DecodeString(footerStr)
+	if err != nil {
+		return nil, jwt.NewValidationError("malformed PASETO footer", jwt.ValidationErrorMalformed)
+	}
+
+	message, sig := signed[:len(signed)-ed25519.SignatureSize], signed[len(signed)-ed25519.SignatureSize:]
+	if !ed25519.Verify(key.Public().(ed25519.PublicKey), pae([]byte(pasetoV4Public), message, footer, nil), sig) {
+		return nil, jwt.NewValidationError("PASETO signature is invalid", jwt.ValidationErrorSignatureInvalid)
+	}
+
+	claims := jwt.MapClaims{}
+	if err := json.Unmarshal(message, &claims); err != nil {
+		return nil, jwt.NewValidationError("malformed PASETO claims", jwt.ValidationErrorMalformed)
+	}
+	for _, name := range pasetoTimeClaims {
+		raw, ok := claims[name]
+		if !ok {
+			continue
+		}
+		str, _ := raw.(string)
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return nil, jwt.NewValidationError("malformed PASETO "+name+" claim", jwt.ValidationErrorMalformed)
+		}
+		claims[name] = float64(t.Unix())
+	}
+	return claims, nil
+}
+
+// --- DPOP ---
+
+// DPoP proofs must be fresh: iat within this window of the server clock. Proof jtis are
+// remembered for twice as long, so a proof can't be replayed while it would still be accepted.
+const dpopProofWindow = time.Minute
+
+// dpopGuard verifies DPoP proof JWTs (RFC 9449) and remembers their jti to reject replays
+type dpopGuard struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // proof jti -> forget after
+}
+
+func newDPoPGuard() *dpopGuard {
+	return &dpopGuard{seen: map[string]time.Time{}}
+}
+
+// dpopJWK is the public key embedded in the proof header, only P-256 keys (ES256) are supported
+type dpopJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// thumbprint returns the RFC 7638 JWK SHA-256 thumbprint, the value bound in cnf.jkt
+func (k dpopJWK) thumbprint() string {
+	// Required members only, in lexicographic order, no whitespace
+	canonical := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// publicKey decodes the JWK into an ECDSA key, rejecting points that are not on the curve
+func (k dpopJWK) publicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported jwk %s/%s, want EC/P-256", k.Kty, k.Crv)
+	}
+	x, errX := base64.RawURLEncoding.DecodeString(k.X)
+	y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+	if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+		return nil, fmt.Errorf("malformed jwk coordinates")
+	}
+	return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+}
+
+// Verify checks a DPoP proof for the request and returns the thumbprint of its key.
+// accessToken is empty at signup, otherwise the proof must carry its hash in ath.
+// origin is PUBLIC_URL, or nil to take scheme and host from the request itself.
+func (g *dpopGuard) Verify(proof string, r *http.Request, origin *url.URL, accessToken string, now time.Time) (string, error) {
+	if proof == "" {
+		return "", fmt.Errorf("%w: missing DPoP header", ErrDPoPProofInvalid)
+	}
+
+	var jwk dpopJWK
+	parser := &jwt.Parser{SkipClaimsValidation: true, ValidMethods: []string{jwt.SigningMethodES256.Alg()}}
+	token, err := parser.Parse(proof, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, fmt.Errorf("typ must be dpop+jwt")
+		}
+		raw, err := json.Marshal(token.Header["jwk"])
+		if err != nil || json.Unmarshal(raw, &jwk) != nil {
+			return nil, fmt.Errorf("malformed jwk header")
+		}
+		return jwk.publicKey()
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDPoPProofInvalid, err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", fmt.Errorf("%w: invalid claims", ErrDPoPProofInvalid)
+	}
+
+	// The proof is bound to this exact request: method and URI without query or fragment.
+	// Behind a TLS-terminating proxy the client's URI is only known from PUBLIC_URL.
+	if origin == nil {
+		origin = &url.URL{Scheme: "http", Host: r.Host}
+		if r.TLS != nil {
+			origin.Scheme = "https"
+		}
+	}
+	if htm, _ := claims["htm"].(string); htm != r.Method {
+		return "", fmt.Errorf("%w: htm %q does not match %s", ErrDPoPProofInvalid, htm, r.Method)
+	}
+	htu, _ := claims["htu"].(string)
+	if u, err := url.Parse(htu); err != nil || !strings.EqualFold(u.Scheme, origin.Scheme) || !strings.EqualFold(u.Host, origin.Host) || u.Path != r.URL.Path {
+		return "", fmt.Errorf("%w: htu %q does not match this request", ErrDPoPProofInvalid, htu)
+	}
+
+	iat, err := claimInt64(claims, "iat")
+	if err != nil || now.Sub(time.Unix(iat, 0)).Abs() > dpopProofWindow {
+		return "", fmt.Errorf("%w: iat missing or outside the %s window", ErrDPoPProofInvalid, dpopProofWindow)
+	}
+
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if ath, _ := claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("%w: ath does not match the access token", ErrDPoPProofInvalid)
+		}
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", fmt.Errorf("%w: missing jti", ErrDPoPProofInvalid)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// A jti past its forget time can't be replayed anyway, its iat is outside the window
+	if forgetAt, ok := g.seen[jti]; ok && !now.After(forgetAt) {
+		return "", fmt.Errorf("%w: proof replayed", ErrDPoPProofInvalid)
+	}
+	g.seen[jti] = now.Add(2 * dpopProofWindow)
+
+	return jwk.thumbprint(), nil
+}
+
+// Prune forgets proof jtis past their replay window and returns how many were dropped.
+// It runs on a ticker rather than per proof, a full scan per request doesn't scale with the map.
+func (g *dpopGuard) Prune(now time.Time) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := 0
+	for id, forgetAt := range g.seen {
+		if now.After(forgetAt) {
+			delete(g.seen, id)
+			n++
+		}
+	}
+	return n
+}
+
+// --- CLOCK ---
+
+// ntpEpochOffset is the number of seconds between 1900-01-01 (NTP era 0) and the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// ClockCheck is the result of the last clock comparison against NTP_CHECK_SERVER
+type ClockCheck struct {
+	Server string
+	Offset time.Duration // server clock minus local clock
+	Err    error
+	At     time.Time
+}
+
+func ntpTime(b []byte) time.Time {
+	sec := binary.BigEndian.Uint32(b[0:4])
+	frac := binary.BigEndian.Uint32(b[4:8])
+	nsec := (int64(frac) * 1e9) >> 32
+	return time.Unix(int64(sec)-ntpEpochOffset, nsec)
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[0:4], uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:8], uint32((int64(t.Nanosecond())<<32)/1e9))
+}
+
+// ntpClockOffset asks an NTP server for the time with a single SNTP exchange (RFC 4330)
+// and returns how far the local clock is behind it
+func ntpClockOffset(ctx context.Context, server string) (time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, fmt.Errorf("ntpClockOffset: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI 0, version 4, mode 3 (client)
+	t1 := time.Now()
+	putNTPTime(req[40:48], t1) // transmit timestamp, echoed back as the originate timestamp
+	if _, err := conn.Write(req); err != nil {
+		return 0, fmt.Errorf("ntpClockOffset: %w", err)
+	}
+
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return 0, fmt.Errorf("ntpClockOffset: %w", err)
+	}
+	switch {
+	case n < 48:
+		return 0, fmt.Errorf("ntpClockOffset: short response of %d bytes", n)
+	case resp[0]&0x07 != 4:
+		return 0, fmt.Errorf("ntpClockOffset: unexpected mode %d", resp[0]&0x07)
+	case resp[1] == 0:
+		return 0, fmt.Errorf("ntpClockOffset: kiss-o'-death %q", resp[12:16])
+	case !bytes.Equal(resp[24:32], req[40:48]):
+		return 0, fmt.Errorf("ntpClockOffset: response does not answer this request")
+	}
+
+	t2, t3 := ntpTime(resp[32:40]), ntpTime(resp[40:48])
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+// checkClock measures the drift against NTP_CHECK_SERVER and warns when it exceeds NTP_MAX_DRIFT_MS.
+// An unreachable server is only a warning, the local clock keeps being trusted.
+func (s *Server) checkClock(ctx context.Context) {
+	cfg := s.Config()
+	if cfg.NTPCheckServer == "" {
+		s.clock.Store(nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	offset, err := ntpClockOffset(ctx, cfg.NTPCheckServer)
+	s.clock.Store(&ClockCheck{Server: cfg.NTPCheckServer, Offset: offset, Err: err, At: time.Now()})
+	switch {
+	case err != nil:
+		log.Printf("Clock check, warning: %s unreachable: %v", cfg.NTPCheckServer, err)
+	case offset.Abs() > cfg.NTPMaxDrift:
+		log.Printf("Clock check, warning: local clock is off by %s from %s, issued tokens are mis-dated", offset, cfg.NTPCheckServer)
+	default:
+		s.debugf("Clock check, offset %s from %s", offset, cfg.NTPCheckServer)
+	}
+}
+
+// --- VERIFY CACHE ---
+
+// verifyCache is an LRU of token rows by jti with a short TTL, so repeated verifications of the
+// same token skip the database. Revocations through this process invalidate their entry, others
+// (another instance, direct database edits) are picked up once the entry expires.
+// A nil cache caches nothing.
+type verifyCache struct {
+	size int
+	ttl  time.Duration
+
+	mu         sync.Mutex
+	order      *list.List // of *verifyCacheEntry, most recently used first
+	items      map[string]*list.Element
+	generation uint64 // bumped by every Invalidate
+
+	hits, misses atomic.Int64
+}
+
+type verifyCacheEntry struct {
+	token     Token
+	expiresAt time.Time
+}
+
+// VerifyCacheStats is the verify cache section of /healthz
+type VerifyCacheStats struct {
+	Size    int     `json:"size"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+func newVerifyCache(size int, ttl time.Duration) *verifyCache {
+	if size == 0 {
+		return nil
+	}
+	return &verifyCache{size: size, ttl: ttl, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get returns a copy of the cached row, callers may modify it
+func (c *verifyCache) Get(jti string) (*Token, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[jti]
+	if !ok || time.Now().After(el.Value.(*verifyCacheEntry).expiresAt) {
+		if ok {
+			c.order.Remove(el)
+			delete(c.items, jti)
+		}
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	c.hits.Add(1)
+	token := el.Value.(*verifyCacheEntry).token
+	return &token, true
+}
+
+// Generation is taken before reading a row from the database and handed to Put
+func (c *verifyCache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Put caches a row read from the database, evicting the least recently used entry when full.
+// A row read before an Invalidate that raced with the read may predate the change that
+// invalidated it, so it's dropped when the generation has moved on since the read started.
+func (c *verifyCache) Put(token Token, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	entry := &verifyCacheEntry{token: token, expiresAt: time.Now().Add(c.ttl)}
+	if el, ok := c.items[token.ID]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[token.ID] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*verifyCacheEntry).token.ID)
+	}
+}
+
+// Invalidate drops the entry of a token that was changed
+func (c *verifyCache) Invalidate(jti string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if el, ok := c.items[jti]; ok {
+		c.order.Remove(el)
+		delete(c.items, jti)
+	}
+}
+
+// Stats returns the cache size and hit rate since start, nil for a disabled cache
+func (c *verifyCache) Stats() *VerifyCacheStats {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	stats := &VerifyCacheStats{Size: size, Hits: c.hits.Load(), Misses: c.misses.Load()}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// --- PROOF OF WORK ---
+
+// powGuard issues stateless hashcash-style challenges signed with a per-process key
+// and remembers solved ones until they expire so a solution can't be replayed.
+type powGuard struct {
+	key []byte
+
+	mu   sync.Mutex
+	used map[string]time.Time // challenge -> expiry
+}
+
+func newPowGuard() *powGuard {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &powGuard{key: key, used: map[string]time.Time{}}
+}
+
+func (g *powGuard) mac(payload string) string {
+	m := hmac.New(sha256.New, g.key)
+	m.Write([]byte(payload))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Issue creates a challenge "<expires>.<nonce>.<difficulty>.<mac>"
+func (g *powGuard) Issue(difficulty int, expiresAt time.Time) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	payload := fmt.Sprintf("%d.%s.%d", expiresAt.Unix(), hex.EncodeToString(nonce), difficulty)
+	return payload + "." + g.mac(payload)
+}
+
+// Verify checks that the challenge was issued by us, is unexpired and unused, carries at least
+// minDifficulty, and that sha256(challenge + ":" + solution) has that many leading zero bits
+func (g *powGuard) Verify(challenge, solution string, minDifficulty int, now time.Time) error {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 {
+		return fmt.Errorf("malformed challenge")
+	}
+
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(g.mac(payload))) {
+		return fmt.Errorf("unknown challenge")
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > expiresAt {
+		return fmt.Errorf("challenge expired")
+	}
+
+	difficulty, err := strconv.Atoi(parts[2])
+	if err != nil || difficulty < minDifficulty {
+		return fmt.Errorf("challenge difficulty too low")
+	}
+
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return fmt.Errorf("invalid solution")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.used[challenge]; ok {
+		return fmt.Errorf("challenge already used")
+	}
+	g.used[challenge] = time.Unix(expiresAt, 0)
+
+	return nil
+}
+
+// Prune forgets solved challenges past their expiry, which Verify refuses anyway, and returns
+// how many were dropped. Like dpopGuard.Prune it runs on a ticker, not on every signup.
+func (g *powGuard) Prune(now time.Time) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := 0
+	for c, exp := range g.used {
+		if now.Unix() > exp.Unix() {
+			delete(g.used, c)
+			n++
+		}
+	}
+	return n
+}
+
+// leadingZeroBits counts the leading zero bits of b
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+// --- REDACTION ---
+
+// redactedMarker replaces sensitive values in the access, error and audit logs
+const redactedMarker = "REDACTED"
+
+// sensitivePattern matches credentials by shape: JWS and JWE compact serializations (a base64url
+// JSON header starts with "eyJ"), PASETO tokens, and the credentials of Authorization schemes.
+// The scheme is kept, the rest is masked. URL-encoded spaces are matched for query strings.
+var sensitivePattern = regexp.MustCompile(`((?i:bearer|dpop|basic)(?: |%20|\+))[A-Za-z0-9._~+/=-]+|eyJ[A-Za-z0-9_-]*(?:\.[A-Za-z0-9_-]*){2,4}|v4\.public\.[A-Za-z0-9_-]+(?:\.[A-Za-z0-9_-]+)?`)
+
+// minRedactedSecret is the shortest configured secret masked literally, shorter ones would mask
+// ordinary words and numbers all over the log
+const minRedactedSecret = 8
+
+// Redactor masks token-shaped values and the configured secrets in log output
+type Redactor struct {
+	secrets atomic.Pointer[[][]byte]
+}
+
+// logRedactor filters the standard logger (access and error log, http.Server errors included)
+// and the audit log
+var logRedactor = &Redactor{}
+
+// SetSecrets replaces the masked secrets with those of cfg, called on load and reload
+func (r *Redactor) SetSecrets(cfg *Config) {
+	var secrets [][]byte
+	add := func(secret []byte) {
+		if len(secret) < minRedactedSecret {
+			return
+		}
+		secrets = append(secrets, secret)
+		// The audit log is JSON, where <, >, &, quotes and control characters are escaped
+		if quoted, err := json.Marshal(string(secret)); err == nil {
+			if escaped := quoted[1 : len(quoted)-1]; !bytes.Equal(escaped, secret) {
+				secrets = append(secrets, escaped)
+			}
+		}
+	}
+
+	if cfg.JWTSecret != nil {
+		if secret, err := cfg.JWTSecret.Secret(); err == nil {
+			add(secret)
+		}
+	}
+	add(cfg.JWTPreviousSecret)
+	for _, tenant := range cfg.Tenants {
+		add(tenant.Secret)
+	}
+	// Keys as they are written in the environment
+	for _, key := range [][]byte{cfg.JWTEncryptionKey, cfg.RowHMACKey} {
+		if key != nil {
+			add([]byte(base64.StdEncoding.EncodeToString(key)))
+		}
+	}
+	if cfg.PasetoKey != nil {
+		add([]byte(hex.EncodeToString(cfg.PasetoKey)))
+		add([]byte(hex.EncodeToString(cfg.PasetoKey.Seed())))
+	}
+	r.secrets.Store(&secrets)
+}
+
+// Redact returns p with sensitive values replaced by redactedMarker
+func (r *Redactor) Redact(p []byte) []byte {
+	p = sensitivePattern.ReplaceAll(p, []byte("${1}"+redactedMarker))
+	if secrets := r.secrets.Load(); secrets != nil {
+		for _, secret := range *secrets {
+			p = bytes.ReplaceAll(p, secret, []byte(redactedMarker))
+		}
+	}
+	return p
+}
+
+// Writer returns a writer redacting everything written to out
+func (r *Redactor) Writer(out io.Writer) io.Writer {
+	return redactingWriter{r: r, out: out}
+}
+
+type redactingWriter struct {
+	r   *Redactor
+	out io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(w.r.Redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// --- AUDIT ---
+
+// Audit actions, part of the stable audit log schema
+const (
+	AuditTokenIssued  = "token_issued"
+	AuditTokenRevoked = "token_revoked"
+	AuditTokenUpdated = "token_updated"
+	AuditVerifyFailed = "verify_failed"
+	AuditAdminAction  = "admin_action"
+	AuditKeyRotation  = "key_rotation"
+	AuditDataExport   = "data_export"
+)
+
+// AuditEvent is one line of the audit log. Fields are only ever added, never renamed.
+type AuditEvent struct {
+	Time     time.Time `json:"ts"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor,omitempty"` // token subject, "admin" or "operator"
+	JTI      string    `json:"jti,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// AuditLogger writes security events as JSON lines, separate from the access log.
+// A nil *AuditLogger discards events.
+type AuditLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	out io.Closer // nil for stdout/stderr
+}
+
+// NewAuditLogger opens AUDIT_LOG_OUTPUT: "stdout", "stderr" or a file path appended to.
+// An empty output disables the audit log and returns nil.
+func NewAuditLogger(output string) (*AuditLogger, error) {
+	switch output {
+	case "":
+		return nil, nil
+	case "stdout":
+		return &AuditLogger{enc: json.NewEncoder(logRedactor.Writer(os.Stdout))}, nil
+	case "stderr":
+		return &AuditLogger{enc: json.NewEncoder(logRedactor.Writer(os.Stderr))}, nil
+	}
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("NewAuditLogger: %w", err)
+	}
+	return &AuditLogger{enc: json.NewEncoder(logRedactor.Writer(f)), out: f}, nil
+}
+
+// Emit writes the event, stamping it with the current time if unset
+func (a *AuditLogger) Emit(event AuditEvent) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(event); err != nil {
+		log.Printf("AuditLogger, error writing event: %v", err)
+	}
+}
+
+// Close closes the audit log file, if any
+func (a *AuditLogger) Close() error {
+	if a == nil || a.out == nil {
+		return nil
+	}
+	return a.out.Close()
+}
+
+// --- ACCOUNTING ---
+
+// usageKey identifies one client_usage row: a client and the unix time of the hour's start
+type usageKey struct {
+	ClientID string
+	Hour     int64
+}
+
+// UsageAccountant counts issued tokens per client in memory and writes them to client_usage in
+// batches, so signup never waits on the write. A nil *UsageAccountant discards counts.
+type UsageAccountant struct {
+	mu      sync.Mutex
+	pending map[usageKey]int64
+}
+
+// NewUsageAccountant returns an accountant with nothing pending
+func NewUsageAccountant() *UsageAccountant {
+	return &UsageAccountant{pending: map[usageKey]int64{}}
+}
+
+// Record counts one token issued to clientID at t
+func (a *UsageAccountant) Record(clientID string, t time.Time) {
+	if a == nil || clientID == "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[usageKey{ClientID: clientID, Hour: t.Truncate(time.Hour).Unix()}]++
+}
+
+// Flush writes the pending counts. On failure they are put back for the next flush.
+func (a *UsageAccountant) Flush(ctx context.Context, db *SqliteDB) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	batch := a.pending
+	a.pending = map[usageKey]int64{}
+	a.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := db.AddClientUsage(ctx, batch); err != nil {
+		a.mu.Lock()
+		for key, n := range batch {
+			a.pending[key] += n
+		}
+		a.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// --- SERVER ---
+
+// Server holds server state and dependencies
+type Server struct {
+	SDB SqliteDB
+
+	config atomic.Pointer[Config]
+
+	// Set once the previous secret grace window elapsed and the transition was logged
+	previousSecretExpired atomic.Bool
+
+	pow  *powGuard
+	dpop *dpopGuard
+
+	// IDs generates token ids (jti)
+	IDs IDGenerator
+
+	// Claims rewrites the claims of each issued token before signing
+	Claims ClaimsTransformer
+
+	// Audit receives security events, nil disables them
+	Audit *AuditLogger
+
+	// Usage counts issued tokens per client_id, nil unless CLIENT_ACCOUNTING is on
+	Usage *UsageAccountant
+
+	// Token rows recently read by lookupActiveToken, nil when VERIFY_CACHE_SIZE is 0
+	verifyCache *verifyCache
+
+	// Last clock comparison against NTP_CHECK_SERVER, nil when the check is disabled
+	clock atomic.Pointer[ClockCheck]
+
+	// Number of handler panics recovered by panicMiddleware
+	panics atomic.Int64
+
+	// Requests currently being handled, and the MAX_CONCURRENT_REQUESTS semaphore (nil when unlimited)
+	inFlight atomic.Int64
+	slots    chan struct{}
+
+	// Token rows as of the last refreshTokenCount plus those issued since, checked against MAX_TOTAL_TOKENS.
+	// lastPurge is the unix nano time expired tokens were last deleted to make room.
+	tokenCount     atomic.Int64
+	lastPurge      atomic.Int64
+	tokenCapWarned atomic.Bool
+}
+
+// IDGenerator generates unique token ids
+type IDGenerator interface {
+	NewID() string
+}
+
+// UUIDv4Generator generates random (version 4) UUIDs
+type UUIDv4Generator struct{}
+
+// NewID returns a new random UUID string
+func (UUIDv4Generator) NewID() string {
+	return uuid.New().String()
+}
+
+// ClaimsTransformer adds or changes the claims of a token about to be issued, e.g. roles looked up
+// in an external system. It gets its own copy of the claims and the signup timeout in ctx.
+// Claims that tie the token to its database row are restored afterwards, see transformClaims.
+type ClaimsTransformer interface {
+	Transform(ctx context.Context, claims jwt.MapClaims) (jwt.MapClaims, error)
+}
+
+// IdentityTransformer leaves the claims unchanged, the default
+type IdentityTransformer struct{}
+
+// Transform returns the claims as they are
+func (IdentityTransformer) Transform(_ context.Context, claims jwt.MapClaims) (jwt.MapClaims, error) {
+	return claims, nil
+}
+
+// CommandTransformer runs an external command (CLAIMS_TRANSFORMER_CMD) with the claims as
+// a JSON object on stdin and signs the JSON object it prints instead
+type CommandTransformer struct {
+	Command []string
+}
+
+// Transform runs the command, which is killed when ctx ends
+func (t CommandTransformer) Transform(ctx context.Context, claims jwt.MapClaims) (jwt.MapClaims, error) {
+	input, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, t.Command[0], t.Command[1:]...)
+	cmd.WaitDelay = DefaultClaimsTransformerWaitDelay
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%s: %w: %s", t.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out jwt.MapClaims
+	if err := json.Unmarshal(output, &out); err != nil || out == nil {
+		return nil, fmt.Errorf("%s: output is not a JSON object", t.Command[0])
+	}
+	return out, nil
+}
+
+// transformProtectedClaims are put back as issued after a ClaimsTransformer ran: they must match
+// the token's database row, proof-of-possession key and renewal policy, and the issuer, audience
+// and client that tenant and OAUTH_PROFILE checks and usage accounting rely on
+var transformProtectedClaims = []string{"jti", "iat", "exp", "nbf", "sub", "cnf", "nonce", "sliding", "iss", "aud", "client_id"}
+
+// transformClaims runs the server's ClaimsTransformer within timeout and restores the protected claims
+func (s *Server) transformClaims(ctx context.Context, claims jwt.MapClaims, timeout time.Duration) (jwt.MapClaims, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	out, err := s.Claims.Transform(ctx, maps.Clone(claims))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range transformProtectedClaims {
+		if value, ok := claims[name]; ok {
+			out[name] = value
+		} else {
+			delete(out, name)
+		}
+	}
+	return out, nil
+}
+
+// NewServer creates a new server with the given database and configuration
+func NewServer(database *SqliteDB, cfg *Config) *Server {
+	s := &Server{SDB: *database, pow: newPowGuard(), dpop: newDPoPGuard(), IDs: UUIDv4Generator{}, Claims: IdentityTransformer{}}
+	if len(cfg.ClaimsTransformerCmd) > 0 {
+		s.Claims = CommandTransformer{Command: cfg.ClaimsTransformerCmd}
+	}
+	s.config.Store(cfg)
+	if cfg.MaxConcurrent > 0 {
+		s.slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	s.verifyCache = newVerifyCache(cfg.VerifyCacheSize, cfg.VerifyCacheTTL)
+	return s
+}
+
+// Config returns the current configuration snapshot
+func (s *Server) Config() *Config {
+	return s.config.Load()
+}
+
+// ReloadConfig re-reads configuration and atomically swaps the reloadable settings.
+// Settings that require a restart are kept and a warning is logged if they changed.
+func (s *Server) ReloadConfig() error {
+	next, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	cur := s.Config()
+	if next.ServerAddr != cur.ServerAddr || next.ServerPort != cur.ServerPort {
+		log.Printf("ReloadConfig, listen address change to %s:%s requires a restart", next.ServerAddr, next.ServerPort)
+		next.ServerAddr, next.ServerPort = cur.ServerAddr, cur.ServerPort
+	}
+	if next.MaxConcurrent != cur.MaxConcurrent {
+		log.Printf("ReloadConfig, MAX_CONCURRENT_REQUESTS change requires a restart")
+		next.MaxConcurrent = cur.MaxConcurrent
+	}
+	if next.VerifyCacheSize != cur.VerifyCacheSize || next.VerifyCacheTTL != cur.VerifyCacheTTL {
+		log.Printf("ReloadConfig, verify cache settings change requires a restart")
+		next.VerifyCacheSize, next.VerifyCacheTTL = cur.VerifyCacheSize, cur.VerifyCacheTTL
+	}
+	if next.H2C != cur.H2C {
+		log.Printf("ReloadConfig, H2C change requires a restart")
+		next.H2C = cur.H2C
+	}
+	if next.ProxyProtocol != cur.ProxyProtocol {
+		log.Printf("ReloadConfig, PROXY_PROTOCOL change requires a restart")
+		next.ProxyProtocol = cur.ProxyProtocol
+	}
+	if next.ListenBacklog != cur.ListenBacklog || next.TCPKeepAlive != cur.TCPKeepAlive || next.HTTPKeepAlives != cur.HTTPKeepAlives {
+		log.Printf("ReloadConfig, LISTEN_BACKLOG/TCP_KEEPALIVE_SEC/HTTP_KEEPALIVES change requires a restart")
+		next.ListenBacklog, next.TCPKeepAlive, next.HTTPKeepAlives = cur.ListenBacklog, cur.TCPKeepAlive, cur.HTTPKeepAlives
+	}
+	if next.AuditLogOutput != cur.AuditLogOutput {
+		log.Printf("ReloadConfig, AUDIT_LOG_OUTPUT change requires a restart")
+		next.AuditLogOutput = cur.AuditLogOutput
+	}
+	if next.ClientAccounting != cur.ClientAccounting {
+		log.Printf("ReloadConfig, CLIENT_ACCOUNTING change requires a restart")
+		next.ClientAccounting = cur.ClientAccounting
+	}
+	if next.PprofAddr != cur.PprofAddr {
+		log.Printf("ReloadConfig, PPROF_ADDR change requires a restart")
+		next.PprofAddr = cur.PprofAddr
+	}
+	if !maps.Equal(next.DisabledEndpoints, cur.DisabledEndpoints) {
+		log.Printf("ReloadConfig, ENABLED_ENDPOINTS/DISABLED_ENDPOINTS change requires a restart")
+		next.DisabledEndpoints = cur.DisabledEndpoints
+	}
+	if !slices.Equal(next.ClaimsTransformerCmd, cur.ClaimsTransformerCmd) {
+		log.Printf("ReloadConfig, CLAIMS_TRANSFORMER_CMD change requires a restart")
+		next.ClaimsTransformerCmd = cur.ClaimsTransformerCmd
+	}
+	if !slices.Equal(next.ClaimColumns, cur.ClaimColumns) {
+		log.Printf("ReloadConfig, CLAIM_COLUMNS change requires a restart")
+		next.ClaimColumns = cur.ClaimColumns
+	}
+	if !bytes.Equal(next.RowHMACKey, cur.RowHMACKey) {
+		log.Printf("ReloadConfig, ROW_HMAC_KEY change requires a restart")
+		next.RowHMACKey = cur.RowHMACKey
+	}
+	if next.DatabaseURI != cur.DatabaseURI || next.DatabaseReadConns != cur.DatabaseReadConns ||
+		next.DBBreakerThreshold != cur.DBBreakerThreshold || next.DBBreakerCooldown != cur.DBBreakerCooldown {
+		log.Printf("ReloadConfig, database settings change requires a restart")
+		next.DatabaseURI, next.DatabaseReadConns = cur.DatabaseURI, cur.DatabaseReadConns
+		next.DBBreakerThreshold, next.DBBreakerCooldown = cur.DBBreakerThreshold, cur.DBBreakerCooldown
+	}
+
+	if !bytes.Equal(next.JWTPreviousSecret, cur.JWTPreviousSecret) {
+		s.Audit.Emit(AuditEvent{Action: AuditKeyRotation, Actor: "operator", Detail: "JWT secret rotated on reload"})
+	}
+
+	logRedactor.SetSecrets(next)
+	s.config.Store(next)
+	s.previousSecretExpired.Store(false)
+	return nil
+}
+
+// audit emits a security event attributed to the request's client
+func (s *Server) audit(r *http.Request, action, actor, jti, detail string) {
+	if s.Audit == nil {
+		return
+	}
+	clientIP, _ := collectClientInfo(r)
+	s.Audit.Emit(AuditEvent{Action: action, Actor: actor, JTI: jti, ClientIP: clientIP, Detail: detail})
+}
+
+// revokeIdleTokens revokes the tokens unused for longer than idle, the way a revocation
+// through the API does: each one leaves the verify cache and gets an audit event
+func (s *Server) revokeIdleTokens(ctx context.Context, now time.Time, idle time.Duration) (int, error) {
+	revoked, err := s.SDB.RevokeIdleTokens(ctx, now, now.Add(-idle))
+	if err != nil {
+		return 0, err
+	}
+	for _, token := range revoked {
+		s.verifyCache.Invalidate(token.ID)
+		s.Audit.Emit(AuditEvent{Action: AuditTokenRevoked, Actor: token.Subject, JTI: token.ID, Detail: "idle for longer than " + idle.String()})
+	}
+	return len(revoked), nil
+}
+
+// debugf logs only when LOG_LEVEL=debug
+func (s *Server) debugf(format string, args ...any) {
+	if s.Config().LogLevel == LogLevelDebug {
+		log.Printf(format, args...)
+	}
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+// Output is compact unless the request asks for ?pretty=1, for people reading it in curl.
+// The body is encoded before anything is sent, so a value that fails to encode gets a
+// clean 500 instead of the status already written and a truncated body. That 500 is
+// written here, so callers only log the returned error.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if r.URL.Query().Get("pretty") == "1" {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeJSONError writes the JSON error envelope with the given status
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := writeJSON(w, r, status, ErrorResponse{Error: ErrorBody{Code: code, Message: message}}); err != nil {
+		log.Printf("writeJSONError, error encoding response: %v", err)
+	}
+}
+
+// collectClientInfo extracts client IP and user agent from request
+func collectClientInfo(r *http.Request) (clientIP, userAgent string) {
+	// Extract IP address
+	clientIP = r.Header.Get("X-Forwarded-For")
+	if clientIP == "" {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		} else {
+			clientIP = ip
+		}
+	} else {
+		// X-Forwarded-For can contain multiple IPs, take the first one
+		ips := strings.Split(clientIP, ",")
+		clientIP = strings.TrimSpace(ips[0])
+	}
+
+	// Extract user agent
+	userAgent = r.UserAgent()
+
+	return clientIP, userAgent
+}
+
+// Handle panic errors to prevent server shutdown
+func (s *Server) panicMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				// http.ErrAbortHandler is net/http's way to abort a response, not a bug
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				n := s.panics.Add(1)
+				log.Printf("panicMiddleware, panic #%d in %s %s: %v\n%s", n, r.Method, r.URL.Path, err, debug.Stack())
+
+				// In debug mode let net/http report it as well, aborting the connection
+				if s.Config().LogLevel == LogLevelDebug {
+					panic(err)
+				}
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		// There will be a defer with panic handler in each next function
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyMiddleware counts in-flight requests and sheds load with 503 once MAX_CONCURRENT_REQUESTS are running.
+// Requests are rejected immediately rather than queued, so a client retry lands after some work has drained.
+func (s *Server) concurrencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.slots != nil {
+			select {
+			case s.slots <- struct{}{}:
+				defer func() { <-s.slots }()
+			default:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Server busy", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenanceReadOnlyPosts are POST routes that change nothing, served in MAINTENANCE_MODE too.
+// Batch verification records usage like GET /tokens/validate does, and is a read the same way.
+var maintenanceReadOnlyPosts = map[string]bool{"/tokens/export/verify": true, "/tokens/validate/batch": true}
+
+// maintenanceMiddleware refuses mutating requests (signup, revocation, updates) with 503 while
+// MAINTENANCE_MODE is on. Reads, verification included, are served as usual.
+func (s *Server) maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.Config()
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			if cfg.MaintenanceMode && !maintenanceReadOnlyPosts[r.URL.Path] {
+				w.Header().Set("Retry-After", strconv.Itoa(int(cfg.MaintenanceRetryAfter/time.Second)))
+				http.Error(w, "Down for maintenance", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsMiddleware adds CORS headers for origins in CORS_ALLOWED_ORIGINS and answers their preflights.
+// Other origins get no CORS headers, so browsers keep the response from them.
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.Config()
+		origin := r.Header.Get("Origin")
+		if len(cfg.CORSAllowedOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Whether CORS headers are sent depends on Origin, caches must key on it
+		w.Header().Add("Vary", "Origin")
+		if !cfg.CORSAllowedOrigins[origin] && !cfg.CORSAllowedOrigins["*"] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if cfg.CORSAllowCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else if cfg.CORSAllowedOrigins["*"] {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, DPoP")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// securityHeadersMiddleware sets SECURITY_HEADERS on every response, before the handler so
+// it can still override one. HSTS over plain HTTP is ignored by browsers and would break local
+// development if honoured, so it is only sent when the request came over TLS.
+func (s *Server) securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tls := r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+		for name, value := range s.Config().SecurityHeaders {
+			if name == "Strict-Transport-Security" && !tls {
+				continue
+			}
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timeoutMiddleware bounds each request by its route timeout, answering 503 once it elapses.
+// The handler's context is cancelled at the deadline, so its queries are aborted too.
+// Routes without a timeout are passed through untouched, unbuffered and flushable.
+func (s *Server) timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.Config()
+		timeout, ok := cfg.RouteTimeouts[r.URL.Path]
+		if !ok {
+			timeout = cfg.RequestTimeout
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Built per request so SIGHUP reloads of the timeouts apply immediately
+		http.TimeoutHandler(next, timeout, "Request timed out").ServeHTTP(w, r)
+	})
+}
+
+// timingResponseWriter sets the Server-Timing header right before the response headers are sent
+type timingResponseWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	timing      *requestTiming
+	wroteHeader bool
+}
+
+func (w *timingResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		db := time.Duration(w.timing.db.Load())
+		total := time.Since(w.start)
+		w.Header().Set("Server-Timing", fmt.Sprintf("db;dur=%.3f, total;dur=%.3f",
+			float64(db.Microseconds())/1000, float64(total.Microseconds())/1000))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *timingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Add Server-Timing header with total handler time and the database portion
+func (s *Server) timingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing := &requestTiming{}
+		ctx := context.WithValue(r.Context(), requestTimingKey{}, timing)
+
+		next.ServeHTTP(&timingResponseWriter{ResponseWriter: w, start: time.Now(), timing: timing}, r.WithContext(ctx))
+	})
+}
+
+// Log access requests in proper format
+func (s *Server) logMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		// Errors are always logged, successful requests are sampled with LOG_SAMPLE_RATE
+		if rate := s.Config().LogSampleRate; sw.status < 400 && rate < 1 && mathrand.Float64() >= rate {
+			return
+		}
+
+		// Extract client info
+		ip, userAgent := collectClientInfo(r)
+
+		// Build full URL (path + query), without a query token
+		fullURL := r.URL.Path
+		if r.URL.RawQuery != "" {
+			fullURL += "?" + redactQuery(r.URL.RawQuery)
+		}
+
+		// Log with all information
+		log.Printf("%s %s %s status=%d user_agent=%s\n", ip, r.Method, fullURL, sw.status, userAgent)
+	})
+}
+
+// queryTokenParam is the query parameter ALLOW_QUERY_TOKEN reads the token from
+const queryTokenParam = "access_token"
+
+// redactQuery masks the values of queryTokenParam in a raw query, keeping the rest as sent
+func redactQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(key); err == nil && name == queryTokenParam {
+			params[i] = key + "=REDACTED"
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// statusResponseWriter records the response status for logMiddleware
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// parseJWTToken parses JWT token string and returns token, claims, and jti.
+// Tokens of subjects refused by BLOCKED_SUBJECTS or ALLOWED_SUBJECTS are rejected with ErrSubjectBlocked.
+func (s *Server) parseJWTToken(tokenString string) (*jwt.Token, jwt.MapClaims, string, error) {
+	token, claims, jti, err := s.verifyJWTToken(tokenString)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if subject, _ := claims["sub"].(string); !s.Config().subjectPermitted(subject) {
+		return nil, nil, "", fmt.Errorf("%w: %q", ErrSubjectBlocked, subject)
+	}
+	return token, claims, jti, nil
+}
+
+// verifyJWTToken is parseJWTToken without the subject check, for revocation:
+// a blocked subject's holder must still be able to give up its tokens
+func (s *Server) verifyJWTToken(tokenString string) (*jwt.Token, jwt.MapClaims, string, error) {
+	if tokenString == "" {
+		return nil, nil, "", fmt.Errorf("empty token string")
+	}
+
+	cfg := s.Config()
+	now := time.Now()
+
+	secret, err := cfg.JWTSecret.Secret()
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to load JWT secret: %w", err)
+	}
+
+	// With JWT_ENCRYPT=1 only encrypted tokens are accepted, the nested JWT is verified as usual
+	if cfg.JWTEncryptionKey != nil {
+		if tokenString, err = decryptJWE(tokenString, cfg.JWTEncryptionKey); err != nil {
+			return nil, nil, "", err
+		}
+	}
+
+	// PASETO tokens carry no JOSE header, a bare token stands in for the JWT's
+	paseto := strings.HasPrefix(tokenString, pasetoV4Public)
+	var token *jwt.Token
+	if paseto {
+		var claims jwt.MapClaims
+		if claims, err = parsePaseto(tokenString, cfg.PasetoKey); err == nil {
+			token = &jwt.Token{Raw: tokenString, Header: map[string]interface{}{}, Claims: claims, Valid: true}
+		}
+	} else {
+		token, err = parseHMACToken(tokenString, secret, cfg.Tenants, cfg.VerifyAllowedAlgs)
+	}
+
+	// Fall back to the previous secret while the rotation grace window is open
+	var validationErr *jwt.ValidationError
+	if err != nil && !paseto && errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 && len(cfg.JWTPreviousSecret) > 0 {
+		if cfg.previousSecretValid(now) {
+			token, err = parseHMACToken(tokenString, cfg.JWTPreviousSecret, cfg.Tenants, cfg.VerifyAllowedAlgs)
+		} else if s.previousSecretExpired.CompareAndSwap(false, true) {
+			log.Printf("parseJWTToken, rotation grace window elapsed, previous JWT secret is no longer accepted")
+		}
+	}
+
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if !token.Valid {
+		return nil, nil, "", fmt.Errorf("invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, nil, "", fmt.Errorf("invalid token claims")
+	}
+
+	if err := requireTimeClaims(claims, cfg.RequiredTimeClaims); err != nil {
+		return nil, nil, "", err
+	}
+	if err := validateTimeClaims(claims, now, cfg.ClockSkew); err != nil {
+		return nil, nil, "", err
+	}
+
+	// A PASETO has no typ to check, the access token profile only admits JWTs
+	if paseto && cfg.OAuthProfile != "" {
+		return nil, nil, "", fmt.Errorf("%w: a PASETO is not an access token JWT", ErrTokenProfile)
+	}
+	if cfg.VerifyExpectedTyp != "" && !paseto {
+		if typ, _ := token.Header["typ"].(string); normalizeTyp(typ) != normalizeTyp(cfg.VerifyExpectedTyp) {
+			return nil, nil, "", fmt.Errorf("%w: %q", ErrTokenTypeMismatch, typ)
+		}
+	}
+
+	if cfg.OAuthProfile == OAuthProfileRFC9068 {
+		if err := checkRFC9068Claims(claims, cfg); err != nil {
+			return nil, nil, "", err
+		}
+	}
+
+	// The kid picked the key, the issuer must belong to the same tenant
+	if kid, ok := token.Header["kid"].(string); ok {
+		if iss, _ := claims["iss"].(string); iss != cfg.Tenants[kid].Issuer {
+			return nil, nil, "", fmt.Errorf("issuer %q does not match tenant %q", iss, kid)
+		}
+	}
+
+	jti, err := jtiFromClaims(claims)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return token, claims, jti, nil
+}
+
+// jtiFromClaims returns the jti claim in the canonical form stored by CreateToken.
+// Token ids are UUIDs (UUIDv4Generator), anything else is rejected as malformed.
+func jtiFromClaims(claims jwt.MapClaims) (string, error) {
+	raw, ok := claims["jti"]
+	if !ok {
+		return "", fmt.Errorf("missing jti in token claims")
+	}
+	jti, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("malformed jti in token claims: got %T, want string", raw)
+	}
+	id, err := uuid.Parse(jti)
+	if err != nil {
+		return "", fmt.Errorf("malformed jti in token claims: %w", err)
+	}
+	return id.String(), nil
+}
+
+// parseHMACToken parses and verifies an HMAC-signed token with the given secret,
+// or with the secret of the tenant named by its kid header.
+// Time-based claims are not validated here, see validateTimeClaims.
+func parseHMACToken(tokenString string, secret []byte, tenants map[string]Tenant, allowedAlgs []string) (*jwt.Token, error) {
+	// ValidMethods rejects any other alg before the key is even looked up
+	parser := &jwt.Parser{SkipClaimsValidation: true, ValidMethods: allowedAlgs}
+	return parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		// Validate signing method
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		if rawKid, ok := token.Header["kid"]; ok {
+			kid, _ := rawKid.(string)
+			tenant, ok := tenants[kid]
+			if !ok {
+				return nil, fmt.Errorf("unknown kid: %v", rawKid)
+			}
+			return tenant.Secret, nil
+		}
+		return secret, nil
+	})
+}
+
+// claimInt64 returns a numeric claim as int64. JSON numbers decode as float64, or json.Number
+// with a UseJSONNumber parser. Fractions are truncated like the NumericDate comparisons in jwt,
+// but NaN and values outside the int64 range are an error instead of wrapping on conversion.
+func claimInt64(claims map[string]interface{}, key string) (int64, error) {
+	raw, ok := claims[key]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrTokenMissingClaim, key)
+	}
+
+	var f float64
+	switch v := raw.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		f = v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		var err error
+		if f, err = v.Float64(); err != nil {
+			return 0, fmt.Errorf("%w: %s is %q", ErrTokenInvalidClaim, key, v)
+		}
+	default:
+		return 0, fmt.Errorf("%w: %s is %T", ErrTokenInvalidClaim, key, raw)
+	}
+
+	// float64(math.MaxInt64) rounds up to 2^63, hence the exclusive bound. NaN fails both.
+	if !(f >= math.MinInt64 && f < math.MaxInt64) {
+		return 0, fmt.Errorf("%w: %s is out of range", ErrTokenInvalidClaim, key)
+	}
+	return int64(f), nil
+}
+
+// requireTimeClaims checks that each named claim is present as a NumericDate
+func requireTimeClaims(claims jwt.MapClaims, names []string) error {
+	for _, name := range names {
+		if _, err := claimInt64(claims, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTimeClaims checks exp, nbf and iat against now, tolerating the given clock skew.
+// A token issued further in the future than the skew indicates a misconfigured or malicious issuer.
+// Absent claims are skipped, present ones must be numbers (jwt's Verify* let other types pass).
+func validateTimeClaims(claims jwt.MapClaims, now time.Time, skew time.Duration) error {
+	times := map[string]int64{}
+	for _, name := range []string{"exp", "nbf", "iat"} {
+		if _, ok := claims[name]; !ok {
+			continue
+		}
+		sec, err := claimInt64(claims, name)
+		if err != nil {
+			return err
+		}
+		times[name] = sec
+	}
+
+	if exp, ok := times["exp"]; ok && now.Add(-skew).Unix() > exp {
+		return fmt.Errorf("%w %s ago", ErrTokenExpired, now.Sub(time.Unix(exp, 0)).Truncate(time.Second))
+	}
+	if nbf, ok := times["nbf"]; ok && now.Add(skew).Unix() < nbf {
+		return ErrTokenNotYetValid
+	}
+	if iat, ok := times["iat"]; ok && now.Add(skew).Unix() < iat {
+		return ErrTokenUsedBeforeIssued
+	}
+	return nil
+}
+
+// isTokenRejection reports whether a lookupActiveToken error means the token is no longer
+// good, which rejectToken answers, rather than that the database failed
+func isTokenRejection(err error) bool {
+	return errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenRevoked) || errors.Is(err, ErrTokenIdle) || errors.Is(err, ErrTokenTampered)
+}
+
+// classifyTokenError maps a verification error to an explanation reason, HTTP status and message
+func classifyTokenError(err error) (reason string, status int, message string) {
+	var validationErr *jwt.ValidationError
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		return "expired", http.StatusUnauthorized, "Token expired"
+	case errors.Is(err, ErrTokenNotYetValid):
+		return "not_yet_valid", http.StatusUnauthorized, "Invalid token"
+	case errors.Is(err, ErrTokenUsedBeforeIssued):
+		return "issued_in_future", http.StatusUnauthorized, "Invalid token"
+	case errors.Is(err, ErrTokenMissingClaim):
+		return "missing_claim", http.StatusUnauthorized, "Invalid token"
+	case errors.Is(err, ErrTokenInvalidClaim):
+		return "invalid_claim", http.StatusUnauthorized, "Invalid token"
+	case errors.Is(err, ErrTokenNotFound):
+		return "unknown_jti", http.StatusUnauthorized, "Token not found"
+	case errors.Is(err, ErrTokenRevoked):
+		return "revoked", http.StatusForbidden, "Token revoked"
+	case errors.Is(err, ErrTokenIdle):
+		return "idle", http.StatusUnauthorized, "Token expired"
+	case errors.Is(err, ErrNonceUsed):
+		return "token_used", http.StatusUnauthorized, "Token already used"
+	case errors.Is(err, ErrTokenTampered):
+		return "tampered", http.StatusUnauthorized, "Invalid token"
+	case errors.Is(err, ErrTokenTypeMismatch):
+		return "wrong_typ", http.StatusUnauthorized, "Invalid token"
+	case errors.Is(err, ErrTokenProfile):
+		return "profile_violation", http.StatusUnauthorized, "Invalid token"
+	case errors.Is(err, ErrTokenAudience):
+		return "wrong_aud", http.StatusUnauthorized, "Invalid token"
+	case errors.Is(err, ErrDPoPProofInvalid):
+		return "dpop_invalid", http.StatusUnauthorized, "Invalid DPoP proof"
+	case errors.Is(err, ErrTokenUndecryptable):
+		return "undecryptable", http.StatusUnauthorized, "Invalid token"
+	case errors.Is(err, ErrSubjectBlocked):
+		return "subject_blocked", http.StatusForbidden, "Subject blocked"
+	case errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return "bad_signature", http.StatusUnauthorized, "Invalid token"
+	case errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return "malformed", http.StatusUnauthorized, "Invalid token"
+	case errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorUnverifiable != 0:
+		return "unverifiable", http.StatusUnauthorized, "Invalid token"
+	default:
+		return "invalid", http.StatusUnauthorized, "Invalid token"
+	}
+}
+
+// StatusClientClosedRequest is the nginx convention for a request the client abandoned.
+// The client never sees it, it keeps disconnects apart from failures in logs.
+const StatusClientClosedRequest = 499
+
+// writeInternalError logs err under logPrefix and responds 500. With ERROR_DETAIL=full the body
+// carries the error, with minimal only a random reference logged next to it, so a report can be
+// matched to the log line without the response leaking internals.
+func (s *Server) writeInternalError(w http.ResponseWriter, logPrefix string, err error) {
+	if s.Config().ErrorDetail == ErrorDetailFull {
+		log.Printf("%s: %v", logPrefix, err)
+		http.Error(w, "Internal server error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ref := rand.Text()[:12]
+	log.Printf("%s, ref %s: %v", logPrefix, ref, err)
+	http.Error(w, "Internal server error, ref "+ref, http.StatusInternalServerError)
+}
+
+// writeStoreError logs a failed database call under logPrefix and responds, telling storage problems,
+// outages and abandoned requests apart from bugs. Client disconnects are not logged.
+func (s *Server) writeStoreError(w http.ResponseWriter, logPrefix string, err error) {
+	if errors.Is(err, context.Canceled) {
+		w.WriteHeader(StatusClientClosedRequest)
+		return
+	}
+
+	var openErr breakerOpenError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Request timed out", http.StatusServiceUnavailable)
+	case errors.As(err, &openErr):
+		w.Header().Set("Retry-After", strconv.Itoa(int((openErr.retryAfter+time.Second-1)/time.Second)))
+		http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrStorageFull):
+		http.Error(w, "Insufficient storage", http.StatusInsufficientStorage)
+	case errors.Is(err, ErrStorageReadOnly):
+		http.Error(w, "Database is read-only", http.StatusServiceUnavailable)
+	default:
+		s.writeInternalError(w, logPrefix, err)
+		return
+	}
+	log.Printf("%s: %v", logPrefix, err)
+}
+
+// writeTokenParseError responds to a token that failed parsing or claims validation
+func writeTokenParseError(w http.ResponseWriter, err error) {
+	_, status, message := classifyTokenError(err)
+	http.Error(w, message, status)
+}
+
+// rejectToken responds to a token that failed verification. With VERIFY_EXPLAIN enabled
+// and ?explain=1 the body is a structured explanation instead of a bare message.
+func (s *Server) rejectToken(w http.ResponseWriter, r *http.Request, err error) {
+	reason, status, message := classifyTokenError(err)
+	s.audit(r, AuditVerifyFailed, "", "", reason)
+	if !s.Config().VerifyExplain || r.URL.Query().Get("explain") != "1" {
+		http.Error(w, message, status)
+		return
+	}
+
+	if err := writeJSON(w, r, status, TokenExplanation{Valid: false, Reason: reason, Detail: err.Error()}); err != nil {
+		log.Printf("rejectToken, error encoding response: %v", err)
+	}
+}
+
+// requestToken returns the bearer (or DPoP) token, falling back to the token cookie when COOKIE_NAME is set
+func (s *Server) requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "DPoP "); ok {
+			return token
+		}
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if name := s.Config().CookieName; name != "" {
+		if c, err := r.Cookie(name); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// checkDPoP requires a valid DPoP proof for tokens bound to a key with cnf.jkt.
+// With DPOP_ENABLED every token must be bound.
+func (s *Server) checkDPoP(r *http.Request, tokenString string, claims jwt.MapClaims) error {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	if jkt == "" {
+		if s.Config().DPoPEnabled {
+			return fmt.Errorf("%w: token is not DPoP-bound", ErrDPoPProofInvalid)
+		}
+		return nil
+	}
+
+	thumbprint, err := s.dpop.Verify(r.Header.Get("DPoP"), r, s.Config().PublicURL, tokenString, time.Now())
+	if err != nil {
+		return err
+	}
+	if thumbprint != jkt {
+		return fmt.Errorf("%w: proof key does not match the token binding", ErrDPoPProofInvalid)
+	}
+	return nil
+}
+
+// useNonce spends the nonce of a one-time token, it's a no-op for tokens without one.
+// The nonce is kept until the token expires, after that the token can't verify anyway.
+func (s *Server) useNonce(ctx context.Context, claims jwt.MapClaims, expiresAt time.Time) error {
+	nonce, _ := claims["nonce"].(string)
+	if nonce == "" {
+		return nil
+	}
+	return s.SDB.UseNonce(ctx, nonce, expiresAt)
+}
+
+// lookupActiveToken fetches the token by jti, from the verify cache when enabled,
+// and returns ErrTokenRevoked if it was revoked
+func (s *Server) lookupActiveToken(ctx context.Context, jti string) (*Token, error) {
+	token, ok := s.verifyCache.Get(jti)
+	if !ok {
+		generation := s.verifyCache.Generation()
+		var err error
+		if token, err = s.SDB.GetTokenByID(ctx, jti); err != nil {
+			return nil, err
+		}
+		s.verifyCache.Put(*token, generation)
+	}
+	if token.IsRevoked {
+		return token, fmt.Errorf("lookupActiveToken: %s: %w", jti, ErrTokenRevoked)
+	}
+
+	// Usages aren't cached, with IDLE_TIMEOUT_SEC every lookup reads the last one.
+	// Usage times are whole seconds, so now is truncated to match.
+	if idle := s.Config().IdleTimeout; idle > 0 {
+		lastUsed, err := s.SDB.LastUsedAt(ctx, jti)
+		if err != nil {
+			return nil, err
+		}
+		if time.Now().Truncate(time.Second).Sub(lastUsed) > idle {
+			return token, fmt.Errorf("lookupActiveToken: %s unused since %s: %w", jti, lastUsed.UTC().Format(time.RFC3339), ErrTokenIdle)
+		}
+	}
+	return token, nil
+}
+
+// selfTest mints a token with the configured signing key (and each tenant's) the way a signup would
+// and verifies it through verifyJWTToken, catching key, algorithm and profile misconfiguration before
+// traffic arrives. Subject lists are left out, they apply to callers. The tokens are neither stored nor audited.
+func (s *Server) selfTest() error {
+	cfg := s.Config()
+	tenants := append([]string{""}, slices.Sorted(maps.Keys(cfg.Tenants))...)
+	for _, tenant := range tenants {
+		jti := s.IDs.NewID()
+		grant := tokenGrant{ID: jti, Tenant: tenant, Audience: tokenAudience(cfg, nil)}
+		if cfg.OAuthProfile == OAuthProfileRFC9068 {
+			grant.Subject, grant.ClientID = "selftest", "selftest"
+		}
+		claims := tokenClaims(cfg, grant, time.Now(), int64(time.Minute/time.Second))
+
+		tokenString, err := signToken(cfg, claims, tenant)
+		if err != nil {
+			return fmt.Errorf("tenant %q: failed to sign with %s: %w", tenant, cfg.JWTAlg, err)
+		}
+
+		_, _, gotJTI, err := s.verifyJWTToken(tokenString)
+		if err != nil {
+			return fmt.Errorf("tenant %q: minted token fails verification: %w", tenant, err)
+		}
+		if gotJTI != jti {
+			return fmt.Errorf("tenant %q: verified jti %q, minted %q", tenant, gotJTI, jti)
+		}
+	}
+	return nil
+}
+
+// parseJWTTokenUnverified CVE-2025-30204
+func (s *Server) parseJWTTokenUnverified(tokenString string) (*jwt.Token, jwt.MapClaims, string, error) {
+	if tokenString == "" {
+		return nil, nil, "", fmt.Errorf("empty token string")
+	}
+
+	// Parse JWT token without verification
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{}
+	token, _, err := parser.ParseUnverified(tokenString, claims)
+
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	// ParseUnverified doesn't set token.Valid, so we use the claims directly
+	// claims is already populated by ParseUnverified
+
+	jti, err := jtiFromClaims(claims)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return token, claims, jti, nil
+}
+
+// NotFound handles requests that match no registered route
+func (s *Server) NotFound(w http.ResponseWriter, r *http.Request) {
+	s.debugf("NotFound, unmatched route %s %s", r.Method, r.URL.Path)
+	writeJSONError(w, r, http.StatusNotFound, "not_found", "Not found")
+}
+
+// Ping handles the ping-pong endpoint
+func (s *Server) Ping(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("pong"))
+}
+
+// Healthz reports per-dependency health: database reachability, key material and disk space
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := HealthReport{
+		Status:   HealthStatusOK,
+		Checks:   map[string]HealthCheck{},
+		Panics:   s.panics.Load(),
+		InFlight: s.inFlight.Load(),
+
+		VerifyCache: s.verifyCache.Stats(),
+	}
+
+	// Database reachability with ping latency
+	start := time.Now()
+	if err := s.SDB.TestConnection(r.Context()); err != nil {
+		report.Checks["database"] = HealthCheck{Status: HealthStatusUnhealthy, Message: err.Error()}
+	} else {
+		report.Checks["database"] = HealthCheck{
+			Status:    HealthStatusOK,
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+	}
+
+	// Circuit breaker around store calls, open means requests are failing fast
+	switch state := s.SDB.breaker.State(); state {
+	case BreakerClosed:
+		report.Checks["db_breaker"] = HealthCheck{Status: HealthStatusOK}
+	default:
+		report.Checks["db_breaker"] = HealthCheck{Status: HealthStatusUnhealthy, Message: "circuit breaker " + state}
+	}
+
+	// Local clock against NTP_CHECK_SERVER, tokens are mis-dated when it drifts
+	if c := s.clock.Load(); c != nil {
+		switch {
+		case c.Err != nil:
+			report.Checks["clock"] = HealthCheck{Status: HealthStatusDegraded, Message: c.Err.Error()}
+		case c.Offset.Abs() > s.Config().NTPMaxDrift:
+			report.Checks["clock"] = HealthCheck{Status: HealthStatusDegraded, Message: fmt.Sprintf("clock off by %s from %s", c.Offset, c.Server)}
+		default:
+			report.Checks["clock"] = HealthCheck{Status: HealthStatusOK}
+		}
+	}
+
+	// Key material loaded and within its rotation deadline
+	cfg := s.Config()
+	report.Maintenance = cfg.MaintenanceMode
+	report.SigningKey = signingKeyStats(cfg, time.Now())
+	jwtSecret, err := cfg.JWTSecret.Secret()
+	switch {
+	case err != nil:
+		report.Checks["keys"] = HealthCheck{Status: HealthStatusUnhealthy, Message: "JWT secret is not loaded: " + err.Error()}
+	case string(jwtSecret) == DefaultJWTSecret:
+		report.Checks["keys"] = HealthCheck{Status: HealthStatusDegraded, Message: "default JWT secret in use"}
+	case report.SigningKey.DaysUntilRotation != nil && *report.SigningKey.DaysUntilRotation < 0:
+		report.Checks["keys"] = HealthCheck{Status: HealthStatusDegraded, Message: "JWT secret is past its rotation deadline"}
+	default:
+		report.Checks["keys"] = HealthCheck{Status: HealthStatusOK}
+	}
+
+	// Disk space for the SQLite file
+	if free, err := s.SDB.DiskFreeBytes(); err != nil {
+		report.Checks["disk"] = HealthCheck{Status: HealthStatusDegraded, Message: err.Error()}
+	} else if free < DefaultHealthMinFreeDiskBytes {
+		report.Checks["disk"] = HealthCheck{Status: HealthStatusDegraded, FreeBytes: free, Message: "low disk space"}
+	} else {
+		report.Checks["disk"] = HealthCheck{Status: HealthStatusOK, FreeBytes: free}
+	}
+
+	// Overall status is the worst of the individual checks
+	for _, check := range report.Checks {
+		if check.Status == HealthStatusUnhealthy {
+			report.Status = HealthStatusUnhealthy
+			break
+		}
+		if check.Status == HealthStatusDegraded {
+			report.Status = HealthStatusDegraded
+		}
+	}
+
+	status := http.StatusOK
+	if report.Status == HealthStatusUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+
+	if err := writeJSON(w, r, status, report); err != nil {
+		log.Printf("Healthz, error encoding response: %v", err)
+	}
+}
+
+// jwtLibraryVersion returns the version of the linked jwt/v4 module, false if build info is unavailable
+func jwtLibraryVersion() (string, bool) {
+	// Read build info to get module versions
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", false
+	}
+
+	// Find the jwt/v4 module in dependencies
+	for _, dep := range buildInfo.Deps {
+		if dep.Path == "github.com/golang-jwt/jwt/v4" {
+			return dep.Version, true
+		}
+	}
+	return "unknown", true
+}
+
+// Root returns service identity and links, cheap enough for uptime probes
+func (s *Server) Root(w http.ResponseWriter, r *http.Request) {
+	if !s.Config().RootInfo {
+		s.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jwtVersion, _ := jwtLibraryVersion()
+	info := ServiceInfo{
+		Name:       ServiceName,
+		JWTVersion: jwtVersion,
+		Links: map[string]string{
+			"health":  "/healthz",
+			"version": "/version",
+		},
+	}
+
+	if err := writeJSON(w, r, http.StatusOK, info); err != nil {
+		log.Printf("Root, error encoding response: %v", err)
+	}
+}
+
+// Version handles the version endpoint and returns the JWT library version
+func (s *Server) Version(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jwtVersion, ok := jwtLibraryVersion()
+	if !ok {
+		http.Error(w, "Failed to read build info", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s\n", jwtVersion)
+}
+
+// vacuum runs SqliteDB.Vacuum and logs the reclaimed space
+func (s *Server) vacuum(ctx context.Context) (VacuumResult, error) {
+	start := time.Now()
+
+	before, err := s.SDB.SizeBytes(ctx)
+	if err != nil {
+		return VacuumResult{}, err
+	}
+	if err := s.SDB.Vacuum(ctx); err != nil {
+		return VacuumResult{}, err
+	}
+	after, err := s.SDB.SizeBytes(ctx)
+	if err != nil {
+		return VacuumResult{}, err
+	}
+
+	result := VacuumResult{
+		BeforeBytes: before,
+		AfterBytes:  after,
+		DurationMs:  float64(time.Since(start).Microseconds()) / 1000,
+	}
+	log.Printf("Vacuum, %d -> %d bytes, reclaimed %d bytes in %.1fms", before, after, before-after, result.DurationMs)
+	return result, nil
+}
+
+// AdminVacuum vacuums the database on demand, served on the admin listener only.
+// VACUUM holds the write lock for the whole run, so outside VACUUM_WINDOW it answers
+// 409 Conflict unless the operator passes ?force=1.
+func (s *Server) AdminVacuum(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cfg := s.Config(); !cfg.inVacuumWindow(time.Now()) && r.URL.Query().Get("force") != "1" {
+		msg := fmt.Sprintf("Outside VACUUM_WINDOW %02d:00-%02d:00, pass force=1 to vacuum anyway", cfg.VacuumWindowStart, cfg.VacuumWindowEnd)
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+
+	// VACUUM rewrites the whole file, allow more than the usual 5 seconds
+	ctx, cancel := context.WithTimeout(r.Context(), DefaultVacuumTimeout)
+	defer cancel()
+
+	result, err := s.vacuum(ctx)
+	if err != nil {
+		s.writeInternalError(w, "AdminVacuum, error", err)
+		return
+	}
+	s.audit(r, AuditAdminAction, "admin", "", "vacuum")
+
+	if err := writeJSON(w, r, http.StatusOK, result); err != nil {
+		log.Printf("AdminVacuum, error encoding response: %v", err)
+	}
+}
+
+// AdminBackup streams a consistent copy of the database as a download, served on the admin
+// listener only. The copy is first written to BACKUP_DIR, which needs free space for about
+// the size of the database, and removed once sent.
+func (s *Server) AdminBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), DefaultVacuumTimeout)
+	defer cancel()
+
+	dir := s.Config().BackupDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	size, err := s.SDB.SizeBytes(ctx)
+	if err != nil {
+		s.writeStoreError(w, "AdminBackup, error reading database size", err)
+		return
+	}
+	free, err := diskFreeBytes(dir)
+	if err != nil {
+		s.writeInternalError(w, "AdminBackup, error checking free space", err)
+		return
+	}
+	if uint64(size) > free {
+		log.Printf("AdminBackup, %d bytes free in %s, database is %d bytes", free, dir, size)
+		http.Error(w, "Not enough free space in BACKUP_DIR", http.StatusInsufficientStorage)
+		return
+	}
+
+	f, err := os.CreateTemp(dir, "backup-*.sqlite")
+	if err != nil {
+		s.writeInternalError(w, "AdminBackup, error creating backup file", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	start := time.Now()
+	if err := s.SDB.BackupTo(ctx, f.Name()); err != nil {
+		s.writeStoreError(w, "AdminBackup, error writing backup", err)
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		s.writeInternalError(w, "AdminBackup, error reading backup file", err)
+		return
+	}
+	log.Printf("AdminBackup, wrote %d bytes in %s", info.Size(), time.Since(start).Truncate(time.Millisecond))
+	s.audit(r, AuditAdminAction, "admin", "", "backup")
+
+	name := "tokens-" + start.UTC().Format("20060102T150405Z") + ".sqlite"
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("AdminBackup, error streaming backup: %v", err)
+	}
+}
+
+// maxRevokeBatch bounds the jtis accepted by one /admin/revoke call
+const maxRevokeBatch = 10000
+
+// maxRevokeBodyBytes bounds the /admin/revoke request body, room for maxRevokeBatch quoted jtis
+const maxRevokeBodyBytes = maxRevokeBatch * 64
+
+// RevokeBatchResult represents the /admin/revoke response body
+type RevokeBatchResult struct {
+	Revoked        int      `json:"revoked"`
+	AlreadyRevoked []string `json:"already_revoked"`
+	NotFound       []string `json:"not_found"`
+}
+
+// AdminRevoke revokes a JSON array of jtis at once, for incident response.
+// Served on the admin listener only.
+func (s *Server) AdminRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRevokeBodyBytes)).Decode(&ids); err != nil {
+		http.Error(w, "Invalid JSON body: "+describeJSONError(err), http.StatusBadRequest)
+		return
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	if len(ids) == 0 || len(ids) > maxRevokeBatch {
+		http.Error(w, fmt.Sprintf("Body must list 1 to %d jtis", maxRevokeBatch), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	revoked, alreadyRevoked, missing, err := s.SDB.RevokeTokens(ctx, ids)
+	if err != nil {
+		s.writeStoreError(w, "AdminRevoke, error revoking tokens", err)
+		return
+	}
+	for _, token := range revoked {
+		s.verifyCache.Invalidate(token.ID)
+		s.audit(r, AuditTokenRevoked, token.Subject, token.ID, "batch revocation")
+	}
+	s.audit(r, AuditAdminAction, "admin", "", fmt.Sprintf("batch revocation of %d tokens", len(revoked)))
+
+	result := RevokeBatchResult{Revoked: len(revoked), AlreadyRevoked: alreadyRevoked, NotFound: missing}
+	if result.AlreadyRevoked == nil {
+		result.AlreadyRevoked = []string{}
+	}
+	if result.NotFound == nil {
+		result.NotFound = []string{}
+	}
+	if err := writeJSON(w, r, http.StatusOK, result); err != nil {
+		log.Printf("AdminRevoke, error encoding response: %v", err)
+	}
+}
+
+// AdminIntegrity lists tokens whose row no longer matches its ROW_HMAC_KEY signature,
+// i.e. rows edited outside the service. Scans the whole table. Served on the admin listener only.
+func (s *Server) AdminIntegrity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Config().RowHMACKey == nil {
+		http.Error(w, "Row signatures are disabled, set ROW_HMAC_KEY", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), DefaultVacuumTimeout)
+	defer cancel()
+
+	mismatched, err := s.SDB.VerifyIntegrity(ctx)
+	if err != nil {
+		s.writeStoreError(w, "AdminIntegrity, error verifying rows", err)
+		return
+	}
+	if len(mismatched) > 0 {
+		log.Printf("AdminIntegrity, %d token rows failed signature check", len(mismatched))
+	}
+
+	if err := writeJSON(w, r, http.StatusOK, map[string]any{"mismatched": mismatched}); err != nil {
+		log.Printf("AdminIntegrity, error encoding response: %v", err)
+	}
+}
+
+// AdminIssuance reports the subjects issued the most tokens in the rolling window,
+// to spot one suddenly minting thousands. Served on the admin listener only.
+func (s *Server) AdminIssuance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	window := s.Config().IssuanceWindow
+	if windowStr := r.URL.Query().Get("window_sec"); windowStr != "" {
+		sec, err := strconv.ParseInt(windowStr, 10, 64)
+		if err != nil || sec <= 0 {
+			http.Error(w, "Invalid window_sec parameter", http.StatusBadRequest)
+			return
+		}
+		window = time.Duration(sec) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	counts, err := s.SDB.CountIssuedBySubject(ctx, time.Now().Add(-window), 100)
+	if err != nil {
+		s.writeStoreError(w, "AdminIssuance, error", err)
+		return
+	}
+
+	if err := writeJSON(w, r, http.StatusOK, IssuanceReport{WindowSec: int64(window / time.Second), Subjects: counts}); err != nil {
+		log.Printf("AdminIssuance, error encoding response: %v", err)
+	}
+}
+
+// issuanceBuckets are the bucket widths /admin/issuance/histogram accepts
+var issuanceBuckets = map[string]time.Duration{"hour": time.Hour, "day": 24 * time.Hour}
+
+// maxIssuanceBuckets bounds the series length of one /admin/issuance/histogram response
+const maxIssuanceBuckets = 10000
+
+// AdminIssuanceHistogram returns the number of tokens issued per ?bucket=hour (default) or day
+// over the last ISSUANCE_HISTORY_SEC or ?history_sec=, for capacity planning charts.
+// Served on the admin listener only.
+func (s *Server) AdminIssuanceHistogram(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		bucket = "hour"
+	}
+	width, ok := issuanceBuckets[bucket]
+	if !ok {
+		http.Error(w, `Invalid bucket parameter, must be "hour" or "day"`, http.StatusBadRequest)
+		return
+	}
+
+	history := s.Config().IssuanceHistory
+	if historyStr := r.URL.Query().Get("history_sec"); historyStr != "" {
+		sec, err := strconv.ParseInt(historyStr, 10, 64)
+		if err != nil || sec <= 0 || sec/int64(width/time.Second) > maxIssuanceBuckets {
+			http.Error(w, fmt.Sprintf("Invalid history_sec parameter, must be positive and span at most %d buckets", maxIssuanceBuckets), http.StatusBadRequest)
+			return
+		}
+		history = time.Duration(sec) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// The first bucket is the one holding the start of the history, counted from its own start
+	now := time.Now()
+	first := now.Add(-history).Truncate(width)
+	counts, err := s.SDB.CountIssuedByBucket(ctx, first, width)
+	if err != nil {
+		s.writeStoreError(w, "AdminIssuanceHistogram, error", err)
+		return
+	}
+
+	histogram := IssuanceHistogram{Bucket: bucket, HistorySec: int64(history / time.Second), Buckets: []IssuanceBucket{}}
+	for start := first; !start.After(now); start = start.Add(width) {
+		histogram.Buckets = append(histogram.Buckets, IssuanceBucket{Start: start.UTC(), Issued: counts[start.Unix()]})
+	}
+
+	if err := writeJSON(w, r, http.StatusOK, histogram); err != nil {
+		log.Printf("AdminIssuanceHistogram, error encoding response: %v", err)
+	}
+}
+
+// AdminUsage returns the number of tokens issued per client_id from ?since= (default: all time)
+// until ?until= (default: now), both Unix seconds or RFC3339, for billing and quotas.
+// Counts are kept per hour, so bounds are rounded down to the hour, and the last few seconds of
+// issuance may not be flushed yet. Served on the admin listener only.
+func (s *Server) AdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.Usage == nil {
+		http.Error(w, "Client accounting is disabled, set CLIENT_ACCOUNTING=1", http.StatusNotFound)
+		return
+	}
+
+	since := time.Unix(0, 0)
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		t, err := parseTimeParam(sinceStr)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	// The current hour is included by default
+	until := time.Now().Truncate(time.Hour).Add(time.Hour)
+	if untilStr := r.URL.Query().Get("until"); untilStr != "" {
+		t, err := parseTimeParam(untilStr)
+		if err != nil {
+			http.Error(w, "Invalid until parameter", http.StatusBadRequest)
+			return
+		}
+		until = t.Truncate(time.Hour)
+	}
+	since = since.Truncate(time.Hour)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	clients, err := s.SDB.CountIssuedByClient(ctx, since, until)
+	if err != nil {
+		s.writeStoreError(w, "AdminUsage, error", err)
+		return
+	}
+
+	report := UsageReport{Since: since.UTC(), Until: until.UTC(), Clients: clients}
+	if err := writeJSON(w, r, http.StatusOK, report); err != nil {
+		log.Printf("AdminUsage, error encoding response: %v", err)
+	}
+}
+
+// Tokens returns list of tokens from database, optionally filtered by
+// ?name= and ?user_agent= (substring match), ?client_ip= (exact address or CIDR)
+// ?issued_after= / ?issued_before= (Unix seconds or RFC3339), ?subject= and ?claim_<name>= for
+// CLAIM_COLUMNS (exact).
+// ?expiring_within=N lists only unrevoked tokens expiring in the next N seconds, soonest first.
+func (s *Server) Tokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseTokenFilter(r.URL.Query(), s.Config().ClaimColumns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Conditional GET for pollers. expiring_within depends on the clock, so it is never cached.
+	withinStr := r.URL.Query().Get("expiring_within")
+	if withinStr == "" {
+		version, err := s.SDB.TokensVersion(r.Context(), filter)
+		if err != nil {
+			s.writeStoreError(w, "Tokens, error", err)
+			return
+		}
+
+		// The query string is part of the tag, a different filter is a different representation
+		sum := sha256.Sum256([]byte(version + "?" + r.URL.RawQuery))
+		etag := `W/"` + hex.EncodeToString(sum[:8]) + `"`
+		w.Header().Set("ETag", etag)
+		for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+			if match = strings.TrimSpace(match); match == etag || match == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	var tokens []Token
+	if withinStr != "" {
+		sec, err := strconv.ParseInt(withinStr, 10, 64)
+		if err != nil || sec <= 0 {
+			http.Error(w, "Invalid expiring_within parameter, must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		tokens, err = s.SDB.ListExpiringSoon(r.Context(), time.Duration(sec)*time.Second, filter)
+	} else {
+		tokens, err = s.SDB.ListTokens(r.Context(), filter)
+	}
+	if err != nil {
+		s.writeStoreError(w, "Tokens, error", err)
+		return
+	}
+
+	if err := writeJSON(w, r, http.StatusOK, tokens); err != nil {
+		log.Printf("Tokens, error encoding response: %v", err)
+		return
+	}
+}
+
+// parseTokenFilter reads the /tokens listing filters from the query string
+func parseTokenFilter(q url.Values, claimColumns []string) (TokenFilter, error) {
+	filter := TokenFilter{
+		Name:      q.Get("name"),
+		Subject:   q.Get("subject"),
+		UserAgent: q.Get("user_agent"),
+	}
+
+	// Only configured claims are accepted, their names end up in the query text
+	for _, claim := range claimColumns {
+		if value := q.Get(claimColumn(claim)); value != "" {
+			if filter.Claims == nil {
+				filter.Claims = map[string]string{}
+			}
+			filter.Claims[claim] = value
+		}
+	}
+
+	if clientIP := q.Get("client_ip"); clientIP != "" {
+		if strings.Contains(clientIP, "/") {
+			_, ipNet, err := net.ParseCIDR(clientIP)
+			if err != nil {
+				return filter, fmt.Errorf("Invalid client_ip parameter")
+			}
+			filter.ClientNet = ipNet
+		} else {
+			// Stored addresses are not validated (X-Forwarded-For), so match the text exactly
+			filter.ClientIP = clientIP
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"issued_after", &filter.IssuedAfter},
+		{"issued_before", &filter.IssuedBefore},
+	} {
+		if value := q.Get(p.name); value != "" {
+			t, err := parseTimeParam(value)
+			if err != nil {
+				return filter, fmt.Errorf("Invalid %s parameter, must be Unix seconds or RFC3339", p.name)
+			}
+			*p.dst = t
+		}
+	}
+	if !filter.IssuedAfter.IsZero() && !filter.IssuedBefore.IsZero() && !filter.IssuedAfter.Before(filter.IssuedBefore) {
+		return filter, fmt.Errorf("Invalid range, issued_after must be before issued_before")
+	}
+
+	return filter, nil
+}
+
+// maxSignUpBodyBytes bounds the JSON body accepted by /tokens/auth
+const maxSignUpBodyBytes = 1 << 20
+
+// maxExportBodyBytes bounds the export file accepted by /tokens/export/verify
+const maxExportBodyBytes = 16 << 20
+
+// signToken signs claims with the JWT secret, or the tenant's secret named in kid,
+// or as a PASETO with TOKEN_FORMAT=paseto, and wraps the result in a JWE when JWT_ENCRYPT=1
+func signToken(cfg *Config, claims jwt.MapClaims, tenant string) (string, error) {
+	var tokenString string
+	var err error
+	if cfg.TokenFormat == TokenFormatPaseto {
+		tokenString, err = signPaseto(claims, cfg.PasetoKey)
+	} else {
+		tokenString, err = signJWT(cfg, claims, tenant)
+	}
+	if err != nil {
+		return "", err
+	}
+	if cfg.JWTEncryptionKey != nil {
+		if tokenString, err = encryptJWE(tokenString, cfg.JWTEncryptionKey); err != nil {
+			return "", fmt.Errorf("failed to encrypt: %w", err)
+		}
+	}
+	return tokenString, nil
+}
+
+// signJWT signs claims as a JWT with the configured typ and cty headers
+func signJWT(cfg *Config, claims jwt.MapClaims, tenant string) (string, error) {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(cfg.JWTAlg), claims)
+	token.Header["typ"] = cfg.JWTTyp
+	if cfg.JWTCty != "" {
+		token.Header["cty"] = cfg.JWTCty
+	}
+
+	secret, err := cfg.JWTSecret.Secret()
+	if err != nil {
+		return "", fmt.Errorf("failed to load JWT secret: %w", err)
+	}
+	if tenant != "" {
+		token.Header["kid"] = tenant
+		secret = cfg.Tenants[tenant].Secret
+	}
+	return token.SignedString(secret)
+}
+
+// slidingRenewal returns the new exp of a sliding token that is in its renewal window,
+// the second half of its ttl, and false when it isn't due or has reached its absolute max
+func slidingRenewal(claims jwt.MapClaims, now time.Time) (time.Time, bool) {
+	sliding, _ := claims["sliding"].(map[string]interface{})
+	ttl, _ := claimInt64(sliding, "ttl")
+	maxExp, _ := claimInt64(sliding, "max")
+	exp, _ := claimInt64(claims, "exp")
+	if ttl <= 0 || now.Unix() < exp-ttl/2 {
+		return time.Time{}, false
+	}
+
+	next := min(now.Unix()+ttl, maxExp)
+	if next <= exp {
+		return time.Time{}, false
+	}
+	return time.Unix(next, 0), true
+}
+
+// renewSliding re-issues a sliding token due for renewal with a later exp, returning "" when it
+// isn't due or sliding expiration was turned off since it was issued. The token is signed first,
+// then the database expiry moves, conditioned on the exp being renewed, so of concurrent
+// verifications of one token only a single one renews it. A token with a nonce isn't renewed:
+// the nonce was spent by this verification and is only remembered until the current exp.
+// Nothing is renewed in maintenance mode, moving the expiry is a write like any other.
+func (s *Server) renewSliding(ctx context.Context, token *jwt.Token, claims jwt.MapClaims, dbToken *Token) (string, time.Time, error) {
+	cfg := s.Config()
+	if cfg.SlidingMaxLifetime == 0 || cfg.MaintenanceMode {
+		return "", time.Time{}, nil
+	}
+	if _, ok := claims["nonce"]; ok {
+		return "", time.Time{}, nil
+	}
+	next, ok := slidingRenewal(claims, time.Now())
+	if !ok {
+		return "", time.Time{}, nil
+	}
+
+	renewed := maps.Clone(claims)
+	renewed["exp"] = next.Unix()
+	tenant, _ := token.Header["kid"].(string)
+	tokenString, err := signToken(cfg, renewed, tenant)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if cfg.MaxTokenBytes > 0 && len(tokenString) > cfg.MaxTokenBytes {
+		return "", time.Time{}, fmt.Errorf("renewSliding: %s: token of %d bytes exceeds the %d byte limit", dbToken.ID, len(tokenString), cfg.MaxTokenBytes)
+	}
+
+	exp, _ := claimInt64(claims, "exp")
+	extended, err := s.SDB.ExtendTokenExpiry(ctx, *dbToken, time.Unix(exp, 0), next)
+	if err != nil || !extended {
+		return "", time.Time{}, err
+	}
+	s.verifyCache.Invalidate(dbToken.ID)
+	return tokenString, next, nil
+}
+
+// refreshTokenCount reloads the token count checked against MAX_TOTAL_TOKENS and logs
+// once when it gets within 10% of the cap
+func (s *Server) refreshTokenCount(ctx context.Context) {
+	n, err := s.SDB.CountTokens(ctx)
+	if err != nil {
+		log.Printf("refreshTokenCount, error: %v", err)
+		return
+	}
+	s.tokenCount.Store(n)
+
+	limit := s.Config().MaxTotalTokens
+	if near := limit > 0 && n >= limit-limit/10; near && !s.tokenCapWarned.Swap(true) {
+		log.Printf("refreshTokenCount, warning: %d tokens stored, MAX_TOTAL_TOKENS is %d", n, limit)
+	} else if !near {
+		s.tokenCapWarned.Store(false)
+	}
+}
+
+// tokenCapacity reports whether another token fits under limit. At the cap expired tokens are
+// deleted first, at most once per DefaultTokenCountInterval so a full table isn't purged per request.
+func (s *Server) tokenCapacity(ctx context.Context, limit int64) bool {
+	if s.tokenCount.Load() < limit {
+		return true
+	}
+
+	last := s.lastPurge.Load()
+	now := time.Now()
+	if now.Sub(time.Unix(0, last)) < DefaultTokenCountInterval || !s.lastPurge.CompareAndSwap(last, now.UnixNano()) {
+		return false
+	}
+
+	purgeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	n, err := s.SDB.DeleteExpiredTokens(purgeCtx, now)
+	if err != nil {
+		log.Printf("tokenCapacity, error deleting expired tokens: %v", err)
+		return false
+	}
+	log.Printf("tokenCapacity, MAX_TOTAL_TOKENS %d reached, deleted %d expired tokens", limit, n)
+	s.refreshTokenCount(purgeCtx)
+	return s.tokenCount.Load() < limit
+}
+
+// parseSignUpRequest reads /tokens/auth parameters from a JSON body or a form
+func parseSignUpRequest(w http.ResponseWriter, r *http.Request) (SignUpRequest, error) {
+	var req SignUpRequest
+
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	if strings.TrimSpace(mediaType) == "application/json" {
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSignUpBodyBytes))
+		dec.DisallowUnknownFields()
+
+		if err := dec.Decode(&req); err != nil {
+			return req, fmt.Errorf("Invalid JSON body: %s", describeJSONError(err))
+		}
+		if dec.More() {
+			return req, fmt.Errorf("Invalid JSON body: must contain a single JSON object")
+		}
+		return req, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return req, fmt.Errorf("Failed to parse the form")
+	}
+
+	if expSecStr := r.FormValue("expires_sec"); expSecStr != "" {
+		v, err := strconv.ParseInt(expSecStr, 10, 64)
+		if err != nil {
+			return req, fmt.Errorf("Invalid expires_sec parameter")
+		}
+		req.ExpiresSec = &v
+	}
+	req.Subject = r.FormValue("subject")
+	req.Name = r.FormValue("name")
+	req.Tenant = r.FormValue("tenant")
+	req.Sliding = r.FormValue("sliding") == "1"
+	req.ClientID = r.FormValue("client_id")
+	req.Audience = r.Form["aud"] // repeated for several audiences
+	if claimsStr := r.FormValue("claims"); claimsStr != "" {
+		if err := json.Unmarshal([]byte(claimsStr), &req.Claims); err != nil {
+			return req, fmt.Errorf("Invalid claims parameter, must be a JSON object")
+		}
+	}
+	req.PowChallenge = r.FormValue("pow_challenge")
+	req.PowSolution = r.FormValue("pow_solution")
+
+	return req, nil
+}
+
+// maxAudiences bounds the aud values of one token
+const maxAudiences = 16
+
+// reservedClaims are set by the server and can't be supplied as custom claims
+var reservedClaims = []string{"jti", "iat", "exp", "nbf", "sub", "iss", "aud", "cnf", "nonce", "sliding", "client_id"}
+
+// tokenAudience is the aud of a new token: the requested audiences sorted and deduplicated,
+// with OAUTH_AUDIENCE always among them since the profile requires it
+func tokenAudience(cfg *Config, requested []string) []string {
+	audience := slices.Compact(slices.Sorted(slices.Values(requested)))
+	if cfg.OAuthAudience != "" && !slices.Contains(audience, cfg.OAuthAudience) {
+		audience = append([]string{cfg.OAuthAudience}, audience...)
+	}
+	return audience
+}
+
+// tokenGrant is what a new token is issued for, validated by the caller
+type tokenGrant struct {
+	ID       string
+	Subject  string // "" for anonymous
+	Tenant   string // "" for the default key
+	ClientID string
+	Audience []string // from tokenAudience
+	JKT      string   // thumbprint of the DPoP key the token is bound to
+	Claims   map[string]any
+	Sliding  bool
+}
+
+// tokenClaims builds the claims of a token issued at now for expSec seconds. Shared by /tokens/auth
+// and selfTest, so the startup check mints what a signup would. jti is stored as a string so it
+// matches the database id after a round-trip.
+func tokenClaims(cfg *Config, g tokenGrant, now time.Time, expSec int64) jwt.MapClaims {
+	expiresAt := now.Add(time.Duration(expSec) * time.Second)
+	claims := jwt.MapClaims{
+		"jti": g.ID,             // JWT ID
+		"iat": now.Unix(),       // Issued at
+		"exp": expiresAt.Unix(), // Expiration time
+		"nbf": now.Unix(),       // Not before
+	}
+	if g.Subject != "" {
+		claims["sub"] = g.Subject // Subject
+	}
+	for name, value := range g.Claims {
+		claims[name] = value
+	}
+	if g.JKT != "" {
+		claims["cnf"] = map[string]string{"jkt": g.JKT} // Confirmation, RFC 9449 section 6
+	}
+	if cfg.OneTimeTokens {
+		claims["nonce"] = rand.Text()
+	}
+	if cfg.OAuthIssuer != "" {
+		claims["iss"] = cfg.OAuthIssuer // Issuer
+	}
+	if g.Tenant != "" {
+		claims["iss"] = cfg.Tenants[g.Tenant].Issuer
+	}
+	if len(g.Audience) == 1 {
+		claims["aud"] = g.Audience[0] // Audience
+	} else if len(g.Audience) > 1 {
+		claims["aud"] = g.Audience // RFC 7519 section 4.1.3, an array when there are several
+	}
+	if g.ClientID != "" {
+		claims["client_id"] = g.ClientID // RFC 8693 section 4.3
+	}
+	if g.Sliding {
+		claims["sliding"] = map[string]int64{"ttl": expSec, "max": now.Add(cfg.SlidingMaxLifetime).Unix()}
+	}
+	return claims
+}
+
+// checkCustomClaims enforces the reserved names and the MAX_CUSTOM_CLAIMS / MAX_CUSTOM_CLAIMS_BYTES caps
+func checkCustomClaims(claims map[string]any, cfg *Config) error {
+	if len(claims) == 0 {
+		return nil
+	}
+	for _, name := range reservedClaims {
+		if _, ok := claims[name]; ok {
+			return fmt.Errorf("Invalid claims parameter, %q is reserved", name)
+		}
+	}
+	if len(claims) > cfg.MaxCustomClaims {
+		return fmt.Errorf("Invalid claims parameter, at most %d custom claims allowed", cfg.MaxCustomClaims)
+	}
+
+	// Same encoding as the token payload, so this is what each token grows by
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return fmt.Errorf("Invalid claims parameter")
+	}
+	if len(b) > cfg.MaxCustomClaimsBytes {
+		return fmt.Errorf("Invalid claims parameter, %d bytes exceeds the %d byte limit", len(b), cfg.MaxCustomClaimsBytes)
+	}
+	return nil
+}
+
+// describeJSONError turns a json.Decoder error into a client-facing message naming the field or offset
+func describeJSONError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Sprintf("expected a JSON object, got %s", typeErr.Value)
+		}
+		return fmt.Sprintf("field %q must be %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	case errors.As(err, &maxBytesErr):
+		return fmt.Sprintf("body larger than %d bytes", maxBytesErr.Limit)
+	case errors.Is(err, io.EOF):
+		return "empty body"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "malformed JSON, unexpected end of input"
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for DisallowUnknownFields
+		return "unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	default:
+		return err.Error()
+	}
+}
+
+// TokensAuthChallenge issues a proof-of-work challenge to solve before calling /tokens/auth
+func (s *Server) TokensAuthChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	difficulty := s.Config().PowDifficulty
+	if difficulty == 0 {
+		http.Error(w, "Proof of work is disabled", http.StatusNotFound)
+		return
+	}
+
+	expiresAt := time.Now().Add(DefaultPowChallengeTTL)
+	challenge := PowChallenge{
+		Challenge:  s.pow.Issue(difficulty, expiresAt),
+		Difficulty: difficulty,
+		Algorithm:  "sha256",
+		ExpiresAt:  expiresAt.Unix(),
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := writeJSON(w, r, http.StatusOK, challenge); err != nil {
+		log.Printf("TokensAuthChallenge, error encoding response: %v", err)
+	}
+}
+
+// TokensAuth creates a new JWT token and stores it in the database (imitation of sign-up/login)
+func (s *Server) TokensAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := parseSignUpRequest(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg := s.Config()
+
+	// Anti-abuse: require a solved challenge from /tokens/auth/challenge
+	if cfg.PowDifficulty > 0 {
+		challenge, solution := req.PowChallenge, req.PowSolution
+		if challenge == "" || solution == "" {
+			http.Error(w, "Missing pow_challenge or pow_solution parameter", http.StatusForbidden)
+			return
+		}
+		if err := s.pow.Verify(challenge, solution, cfg.PowDifficulty, time.Now()); err != nil {
+			http.Error(w, "Invalid proof of work: "+err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	expSec := int64(24 * time.Hour / time.Second) // default 24 hours
+	if req.ExpiresSec != nil {
+		expSec = *req.ExpiresSec
+	}
+
+	// Server-side ceiling, compared in seconds so huge values can't overflow time.Duration
+	if maxSec := int64(cfg.MaxExpiry / time.Second); cfg.MaxExpiry > 0 && expSec > maxSec {
+		if cfg.MaxExpiryPolicy == MaxExpiryPolicyReject {
+			http.Error(w, "expires_sec exceeds the maximum allowed expiry", http.StatusBadRequest)
+			return
+		}
+		log.Printf("TokensAuth, expires_sec %d exceeds maximum, clamped to %d", expSec, maxSec)
+		expSec = maxSec
+	}
+	expDuration := time.Duration(expSec) * time.Second
+
+	// Optional subject, lets the holder manage their sessions via /tokens/sessions
+	subject := req.Subject
+	if len(subject) > 255 {
+		http.Error(w, "Invalid subject parameter", http.StatusBadRequest)
+		return
+	}
+	if subject != "" && !subjectAuthenticated(r, cfg) {
+		s.debugf("TokensAuth, subject %q without SUBJECT_AUTH_TOKEN", subject)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="subject"`)
+		http.Error(w, "Subject requires authentication", http.StatusUnauthorized)
+		return
+	}
+	if !cfg.subjectPermitted(subject) {
+		http.Error(w, "Subject blocked", http.StatusForbidden)
+		return
+	}
+	if cfg.OAuthProfile == OAuthProfileRFC9068 && (subject == "" || req.ClientID == "" || len(req.ClientID) > 255) {
+		http.Error(w, "subject and client_id are required by the "+cfg.OAuthProfile+" profile", http.StatusBadRequest)
+		return
+	}
+
+	audience := tokenAudience(cfg, req.Audience)
+	if len(audience) > maxAudiences || slices.ContainsFunc(audience, func(aud string) bool { return aud == "" || len(aud) > 255 }) {
+		http.Error(w, fmt.Sprintf("Invalid aud parameter, at most %d non-empty audiences", maxAudiences), http.StatusBadRequest)
+		return
+	}
+
+	// Optional human-readable label, stored but not signed into the token
+	if len(req.Name) > 255 {
+		http.Error(w, "Invalid name parameter", http.StatusBadRequest)
+		return
+	}
+	if len(req.ClientID) > 255 {
+		http.Error(w, "Invalid client_id parameter", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkCustomClaims(req.Claims, cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Tenant != "" {
+		if _, ok := cfg.Tenants[req.Tenant]; !ok {
+			http.Error(w, "Unknown tenant", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A one-time token's nonce would be spent by the verification that renews it
+	if req.Sliding && (cfg.SlidingMaxLifetime == 0 || cfg.OneTimeTokens) {
+		http.Error(w, "Sliding expiration is disabled", http.StatusBadRequest)
+		return
+	}
+
+	// Sender-constrained tokens: bind to the key that signed the DPoP proof
+	var jkt string
+	if cfg.DPoPEnabled {
+		var err error
+		if jkt, err = s.dpop.Verify(r.Header.Get("DPoP"), r, cfg.PublicURL, "", time.Now()); err != nil {
+			s.debugf("TokensAuth, rejected DPoP proof: %v", err)
+			http.Error(w, "Invalid DPoP proof", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if cfg.MaxTotalTokens > 0 && !s.tokenCapacity(r.Context(), cfg.MaxTotalTokens) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(DefaultTokenCountInterval/time.Second)))
+		http.Error(w, "Token capacity reached", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Setup token
+	now := time.Now()
+	expiresAt := now.Add(expDuration)
+	tokenID := s.IDs.NewID()
+
+	claims := tokenClaims(cfg, tokenGrant{
+		ID:       tokenID,
+		Subject:  subject,
+		Tenant:   req.Tenant,
+		ClientID: req.ClientID,
+		Audience: audience,
+		JKT:      jkt,
+		Claims:   req.Claims,
+		Sliding:  req.Sliding,
+	}, now, expSec)
+
+	if claims, err = s.transformClaims(r.Context(), claims, cfg.ClaimsTransformerTimeout); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("SignUp, claims transformer timed out after %s", cfg.ClaimsTransformerTimeout)
+			http.Error(w, "Claims transformer timed out", http.StatusServiceUnavailable)
+			return
+		}
+		s.writeInternalError(w, "SignUp, error transforming claims", err)
+		return
+	}
+
+	tokenString, err := signToken(cfg, claims, req.Tenant)
+	if err != nil {
+		s.writeInternalError(w, "SignUp, error signing token", err)
+		return
+	}
+
+	// Refuse at mint time what a proxy would otherwise drop as an oversized header at use time
+	if cfg.MaxTokenBytes > 0 && len(tokenString) > cfg.MaxTokenBytes {
+		http.Error(w, fmt.Sprintf("Token of %d bytes exceeds the %d byte limit, reduce the claims payload", len(tokenString), cfg.MaxTokenBytes), http.StatusBadRequest)
+		return
+	}
+
+	// Collect client info for replay analysis
+	clientIP, userAgent := collectClientInfo(r)
+
+	t := Token{
+		ID:        tokenID,
+		IsRevoked: false,
+		IssuedAt:  now,
+		ExpiresAt: expiresAt,
+		UpdatedAt: now,
+		ClientIP:  clientIP,
+		UserAgent: userAgent,
+		Subject:   subject,
+		Name:      req.Name,
+
+		ClaimValues: claimColumnValues(claims, cfg.ClaimColumns),
+
+		Token: tokenString,
+	}
+
+	// Store token in database
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// With UNIQUE_NAMED_TOKENS a named token replaces the subject's previous one of that name
+	var replaced []string
+	if cfg.UniqueNamedTokens && t.Subject != "" && t.Name != "" {
+		replaced, err = s.SDB.RotateNamedToken(ctx, t)
+	} else {
+		err = s.SDB.CreateToken(ctx, t)
+	}
+	if err != nil {
+		if errors.Is(err, ErrTokenExists) {
+			log.Printf("SignUp, error storing token: %v", err)
+			http.Error(w, "Token already exists", http.StatusConflict)
+			return
+		}
+		s.writeStoreError(w, "SignUp, error storing token", err)
+		return
+	}
+	s.tokenCount.Add(1)
+	// Billing follows client_id only when the front end holding SUBJECT_AUTH_TOKEN vouches for it
+	if clientID, ok := claims["client_id"].(string); ok && subjectAuthenticated(r, cfg) {
+		s.Usage.Record(clientID, now)
+	}
+
+	// Record token usage (creation)
+	if err := s.SDB.CreateTokenUsage(ctx, t.ID, now.Unix(), clientIP, r.UserAgent(), r.Method, http.StatusCreated); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("TokensAuth, error recording token usage: %v", err)
+		}
+	}
+	s.audit(r, AuditTokenIssued, subject, t.ID, "")
+	for _, id := range replaced {
+		s.verifyCache.Invalidate(id)
+		s.audit(r, AuditTokenRevoked, subject, id, "replaced by "+t.ID)
+	}
+
+	if cfg.CookieName != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cfg.CookieName,
+			Value:    tokenString,
+			Path:     cfg.CookiePath,
+			Domain:   cfg.CookieDomain,
+			Expires:  expiresAt,
+			Secure:   cfg.CookieSecure,
+			HttpOnly: true,
+			SameSite: cfg.CookieSameSite,
+		})
+	}
+
+	// The full audit record stays server-side, the client only gets its credential
+	tokenType := "Bearer"
+	if jkt != "" {
+		tokenType = "DPoP"
+	}
+	resp := SignUpResponse{
+		Token:     tokenString,
+		JTI:       t.ID,
+		TokenType: tokenType,
+		ExpiresAt: expiresAt,
+		ExpiresIn: int64(expiresAt.Sub(now) / time.Second),
+	}
+
+	if err := writeJSON(w, r, http.StatusOK, resp); err != nil {
+		log.Printf("SignUp, error encoding response: %v", err)
+		return
+	}
+}
+
+// TokensValidate checks the token valid status, and with ?aud= that it was issued for that audience
+func (s *Server) TokensValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Headers and the cookie take precedence, ?access_token= is for clients that can set neither
+	tokenString := s.requestToken(r)
+	if tokenString == "" && s.Config().AllowQueryToken {
+		tokenString = r.URL.Query().Get(queryTokenParam)
+	}
+	if tokenString == "" {
+		http.Error(w, "Missing token parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Parse and validate JWT token, ?aud= additionally requires that audience among the token's
+	parsed, claims, jti, err := s.parseJWTToken(tokenString)
+	if err == nil {
+		err = s.checkDPoP(r, tokenString, claims)
+	}
+	if aud := r.URL.Query().Get("aud"); err == nil && aud != "" && !claims.VerifyAudience(aud, true) {
+		err = fmt.Errorf("%w: %q", ErrTokenAudience, aud)
+	}
+	if err != nil {
+		s.rejectToken(w, r, err)
+		return
+	}
+
+	// Check if token is revoked in database
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	dbToken, err := s.lookupActiveToken(ctx, jti)
+	if err == nil {
+		err = s.useNonce(ctx, claims, dbToken.ExpiresAt)
+	}
+	switch {
+	case isTokenRejection(err), errors.Is(err, ErrNonceUsed):
+		// If token not found in database, consider it invalid
+		s.rejectToken(w, r, err)
+		return
+	case err != nil:
+		s.writeStoreError(w, "TokensValidate, error querying token", err)
+		return
+	}
+
+	// Collect client info for usage tracking
+	clientIP, userAgent := collectClientInfo(r)
+
+	// Record token usage
+	now := time.Now()
+	if err := s.SDB.CreateTokenUsage(ctx, jti, now.Unix(), clientIP, userAgent, r.Method, http.StatusOK); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("TokensValidate, error recording token usage: %v", err)
+		}
+		// Don't fail the request if usage recording fails, just log it
+	}
+
+	// Token is valid and not revoked, return full token
+	dbToken.Token = tokenString
+
+	// Sliding tokens in their renewal window come back with a later exp, the old one stays valid until its own
+	renewed, expiresAt, err := s.renewSliding(ctx, parsed, claims, dbToken)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("TokensValidate, error renewing sliding token: %v", err)
+	}
+	if renewed != "" {
+		dbToken.Token, dbToken.ExpiresAt = renewed, expiresAt
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	if err := writeJSON(w, r, http.StatusOK, dbToken); err != nil {
+		log.Printf("TokensValidate, error encoding response: %v", err)
+		return
+	}
+}
+
+// maxBatchTokens bounds the tokens of one /tokens/validate/batch request, and with it the query size
+const maxBatchTokens = 100
+
+// maxBatchBodyBytes bounds the /tokens/validate/batch request body
+const maxBatchBodyBytes = 1 << 20
+
+// TokensValidateBatch verifies a JSON array of tokens in one round trip, for gateways checking
+// many at once. Each token goes through the same checks as /tokens/validate, ?aud= included, with
+// the rows of all of them read in a single query. The response lists a result per token in request
+// order, an invalid token doesn't fail the request. Sliding tokens are not renewed here. The DPoP
+// header carries one proof, which is bound to one token, so a batch may hold a single DPoP-bound
+// token and one with more is refused.
+func (s *Server) TokensValidateBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var tokens []string
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes))
+	if err := dec.Decode(&tokens); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			http.Error(w, "Invalid JSON body: must be an array of token strings", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Invalid JSON body: "+describeJSONError(err), http.StatusBadRequest)
+		return
+	}
+	if len(tokens) == 0 || len(tokens) > maxBatchTokens {
+		http.Error(w, fmt.Sprintf("Invalid token list, must hold 1 to %d tokens", maxBatchTokens), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BatchVerifyResult, len(tokens))
+	reject := func(i int, err error) {
+		reason, _, _ := classifyTokenError(err)
+		results[i] = BatchVerifyResult{Reason: reason, JTI: results[i].JTI}
+		s.audit(r, AuditVerifyFailed, "", "", reason)
+	}
+
+	// Signatures and claims first, the database is only asked about tokens that pass
+	claimsOf := make([]jwt.MapClaims, len(tokens))
+	bound := 0
+	for i, tokenString := range tokens {
+		_, claims, jti, err := s.parseJWTToken(tokenString)
+		if err != nil {
+			reject(i, err)
+			continue
+		}
+		if cnf, _ := claims["cnf"].(map[string]interface{}); cnf["jkt"] != nil {
+			bound++
+		}
+		claimsOf[i] = claims
+		results[i].JTI = jti
+	}
+	// Checked before any proof is verified, verifying spends the proof's jti
+	if bound > 1 {
+		http.Error(w, "Invalid token list, at most one DPoP-bound token per batch", http.StatusBadRequest)
+		return
+	}
+
+	aud := r.URL.Query().Get("aud")
+	var ids []string
+	for i, tokenString := range tokens {
+		claims := claimsOf[i]
+		if claims == nil {
+			continue
+		}
+		err := s.checkDPoP(r, tokenString, claims)
+		if err == nil && aud != "" && !claims.VerifyAudience(aud, true) {
+			err = fmt.Errorf("%w: %q", ErrTokenAudience, aud)
+		}
+		if err != nil {
+			claimsOf[i] = nil
+			reject(i, err)
+			continue
+		}
+		ids = append(ids, results[i].JTI)
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	states, err := s.SDB.GetTokensByIDs(ctx, ids)
+	if err != nil {
+		s.writeStoreError(w, "TokensValidateBatch, error querying tokens", err)
+		return
+	}
+
+	// The checks of lookupActiveToken, against the rows read above
+	now := time.Now()
+	idle := s.Config().IdleTimeout
+	var used []string
+	for i := range tokens {
+		if claimsOf[i] == nil {
+			continue
+		}
+		jti := results[i].JTI
+		state, ok := states[jti]
+		switch {
+		case !ok:
+			err = fmt.Errorf("TokensValidateBatch: %s: %w", jti, ErrTokenNotFound)
+		case state.Tampered:
+			err = fmt.Errorf("TokensValidateBatch: %s: %w", jti, ErrTokenTampered)
+		case state.Token.IsRevoked:
+			err = fmt.Errorf("TokensValidateBatch: %s: %w", jti, ErrTokenRevoked)
+		case idle > 0 && now.Truncate(time.Second).Sub(state.LastUsed) > idle:
+			err = fmt.Errorf("TokensValidateBatch: %s: %w", jti, ErrTokenIdle)
+		default:
+			// Only one-time tokens cost a write of their own
+			if err = s.useNonce(ctx, claimsOf[i], state.Token.ExpiresAt); err != nil && !errors.Is(err, ErrNonceUsed) {
+				s.writeStoreError(w, "TokensValidateBatch, error using nonce", err)
+				return
+			}
+		}
+		if err != nil {
+			reject(i, err)
+			continue
+		}
+
+		expiresAt := state.Token.ExpiresAt
+		results[i] = BatchVerifyResult{Valid: true, JTI: jti, Subject: state.Token.Subject, ExpiresAt: &expiresAt}
+		used = append(used, jti)
+	}
+
+	clientIP, userAgent := collectClientInfo(r)
+	if err := s.SDB.CreateTokenUsages(ctx, used, now.Unix(), clientIP, userAgent, r.Method, http.StatusOK); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("TokensValidateBatch, error recording token usage: %v", err)
+		}
+	}
+
+	if err := writeJSON(w, r, http.StatusOK, BatchVerifyResponse{Results: results}); err != nil {
+		log.Printf("TokensValidateBatch, error encoding response: %v", err)
+	}
+}
+
+// TokensValidateUnverified CVE-2025-30204
+func (s *Server) TokensValidateUnverified(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	tokenString := strings.TrimPrefix(auth, "Bearer ")
+	if tokenString == "" {
+		http.Error(w, "Missing token parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Parse and validate JWT token
+	_, _, jti, err := s.parseJWTTokenUnverified(tokenString)
 	if err != nil {
-		return fmt.Errorf("CreateTokenUsage: failed to insert: %w", err)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
 	}
-	return nil
-}
 
-// RevokeToken marks a token as revoked in the database and returns the updated token
-func (s *SqliteDB) RevokeToken(ctx context.Context, tokenID string) (*Token, error) {
-	query := `
-	UPDATE tokens 
-	SET is_revoked = 1, updated_at = ?
-	WHERE id = ?
-	RETURNING id, is_revoked, issued_at, expires_at, updated_at, client_ip, user_agent;
-	`
+	// Check if token is revoked in database
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	dbToken, err := s.lookupActiveToken(ctx, jti)
+	switch {
+	case isTokenRejection(err):
+		s.rejectToken(w, r, err)
+		return
+	case err != nil:
+		s.writeStoreError(w, "TokensValidate, error querying token", err)
+		return
+	}
+
+	// Collect client info for usage tracking
+	clientIP, userAgent := collectClientInfo(r)
 
+	// Record token usage
 	now := time.Now()
-	var token Token
-	var issuedAtStr, expiresAtStr, updatedAtStr string
-	var isRevokedInt int
-	var clientIP, userAgent sql.NullString
+	if err := s.SDB.CreateTokenUsage(ctx, jti, now.Unix(), clientIP, userAgent, r.Method, http.StatusOK); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("TokensValidate, error recording token usage: %v", err)
+		}
+		// Don't fail the request if usage recording fails, just log it
+	}
 
-	err := s.db.QueryRowContext(
-		ctx,
-		query,
-		now.Unix(),
-		tokenID,
-	).Scan(
-		&token.ID,
-		&isRevokedInt,
-		&issuedAtStr,
-		&expiresAtStr,
-		&updatedAtStr,
-		&clientIP,
-		&userAgent,
-	)
-	if err == sql.ErrNoRows {
-		return nil, sql.ErrNoRows // Token not found
+	// Token is valid and not revoked, return full token
+	dbToken.Token = tokenString
+
+	if err := writeJSON(w, r, http.StatusOK, dbToken); err != nil {
+		log.Printf("TokensValidate, error encoding response: %v", err)
+		return
 	}
-	if err != nil {
-		return nil, fmt.Errorf("RevokeToken: failed to update: %w", err)
+}
+
+// parseTimeParam parses a query parameter given as Unix seconds or RFC3339
+func parseTimeParam(value string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
 	}
+	return time.Parse(time.RFC3339, value)
+}
 
-	if err := parseTokenFromDb(&token, isRevokedInt, issuedAtStr, expiresAtStr, updatedAtStr, clientIP, userAgent); err != nil {
-		return nil, err
+// Revocations returns revoked jtis (optionally since a timestamp) so verifiers can keep a local blocklist
+func (s *Server) Revocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	return &token, nil
-}
+	since := time.Unix(0, 0)
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		t, err := parseTimeParam(sinceStr)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
 
-// ListTokenUsage returns usage events for a given token ID ordered by timestamp descending
-func (s *SqliteDB) ListTokenUsage(ctx context.Context, tokenID string) ([]TokenUsage, error) {
-	query := `
-	SELECT id, token_id, ts, client_ip, user_agent, method, status
-	FROM token_usages
-	WHERE token_id = ?
-	ORDER BY ts DESC`
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
 
-	rows, err := s.db.QueryContext(ctx, query, tokenID)
+	ids, err := s.SDB.ListRevoked(ctx, since)
 	if err != nil {
-		return nil, fmt.Errorf("ListTokenUsage: failed to query: %w", err)
+		s.writeStoreError(w, "Revocations, error querying revoked tokens", err)
+		return
 	}
-	defer rows.Close()
 
-	usages := []TokenUsage{}
-	for rows.Next() {
-		var usage TokenUsage
-		var tsInt int64
-		var clientIP, userAgent, method sql.NullString
+	// Marshalled up front for the ETag, so ?pretty=1 is handled here rather than by writeJSON
+	list := RevocationList{Since: since.Unix(), JTIs: ids}
+	var body []byte
+	if r.URL.Query().Get("pretty") == "1" {
+		body, err = json.MarshalIndent(list, "", "  ")
+	} else {
+		body, err = json.Marshal(list)
+	}
+	if err != nil {
+		log.Printf("Revocations, error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-		if err := rows.Scan(&usage.ID, &usage.TokenID, &tsInt, &clientIP, &userAgent, &method, &usage.Status); err != nil {
-			return nil, fmt.Errorf("ListTokenUsage: failed to scan row: %w", err)
-		}
+	// Content hash lets polling clients revalidate with If-None-Match
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
 
-		usage.TS = time.Unix(tsInt, 0)
-		usage.ClientIP = clientIP.String
-		usage.UserAgent = userAgent.String
-		usage.Method = method.String
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-		usages = append(usages, usage)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// TokensUsage returns usage of exact token
+func (s *Server) TokensUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("ListTokenUsage: row iteration error: %w", err)
+	tokenParam := r.URL.Query().Get("token")
+	if tokenParam == "" {
+		http.Error(w, "Missing token parameter", http.StatusBadRequest)
+		return
 	}
 
-	return usages, nil
-}
+	_, claims, tokenID, err := s.parseJWTToken(tokenParam)
+	if err == nil {
+		err = s.checkDPoP(r, tokenParam, claims)
+	}
+	if err != nil {
+		writeTokenParseError(w, err)
+		return
+	}
 
-// --- SERVER ---
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
 
-// Server holds server state and dependencies
-type Server struct {
-	SDB       SqliteDB
-	JWTSecret []byte
+	usages, err := s.SDB.ListTokenUsage(ctx, tokenID)
+	if err != nil {
+		s.writeStoreError(w, "TokensUsage, error querying usages", err)
+		return
+	}
+
+	if err := writeJSON(w, r, http.StatusOK, usages); err != nil {
+		log.Printf("TokensUsage, error encoding response: %v", err)
+		return
+	}
 }
 
-// collectClientInfo extracts client IP and user agent from request
-func collectClientInfo(r *http.Request) (clientIP, userAgent string) {
-	// Extract IP address
-	clientIP = r.Header.Get("X-Forwarded-For")
-	if clientIP == "" {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			clientIP = r.RemoteAddr
-		} else {
-			clientIP = ip
+// TokensSessions lists (GET) or revokes (DELETE ?id=) the active sessions of the bearer token's subject.
+// A subject can only see and revoke its own sessions.
+func (s *Server) TokensSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenString := s.requestToken(r)
+	if tokenString == "" {
+		http.Error(w, "Missing token parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Listing is refused to blocked subjects, revoking a session is not
+	parse := s.parseJWTToken
+	if r.Method == http.MethodDelete {
+		parse = s.verifyJWTToken
+	}
+	_, claims, jti, err := parse(tokenString)
+	if err == nil {
+		err = s.checkDPoP(r, tokenString, claims)
+	}
+	if err != nil {
+		s.rejectToken(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.lookupActiveToken(ctx, jti); err != nil {
+		if isTokenRejection(err) {
+			s.rejectToken(w, r, err)
+			return
 		}
-	} else {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ips := strings.Split(clientIP, ",")
-		clientIP = strings.TrimSpace(ips[0])
+		s.writeStoreError(w, "TokensSessions, error querying token", err)
+		return
 	}
 
-	// Extract user agent
-	userAgent = r.UserAgent()
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		http.Error(w, "Token has no subject", http.StatusForbidden)
+		return
+	}
 
-	return clientIP, userAgent
-}
+	if r.Method == http.MethodGet {
+		sessions, err := s.SDB.ListSessions(ctx, subject, time.Now())
+		if err != nil {
+			s.writeStoreError(w, "TokensSessions, error querying sessions", err)
+			return
+		}
 
-// Handle panic errors to prevent server shutdown
-func (s *Server) panicMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if err := recover(); err != nil {
-				fmt.Printf("panicMiddleware, error: %v", err)
-				http.Error(w, "Internal server error", 500)
-			}
-		}()
-		// There will be a defer with panic handler in each next function
-		next.ServeHTTP(w, r)
-	})
-}
+		if err := writeJSON(w, r, http.StatusOK, sessions); err != nil {
+			log.Printf("TokensSessions, error encoding response: %v", err)
+		}
+		return
+	}
 
-// Log access requests in proper format
-func (s *Server) logMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("id")
+	if sessionID == "" {
+		http.Error(w, "Missing id parameter", http.StatusBadRequest)
+		return
+	}
 
-		next.ServeHTTP(w, r)
+	// Sessions of other subjects are reported as not found to avoid leaking their existence
+	target, err := s.SDB.GetTokenByID(ctx, sessionID)
+	if errors.Is(err, ErrTokenNotFound) || (err == nil && target.Subject != subject) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, "TokensSessions, error querying session", err)
+		return
+	}
 
-		// Extract client info
-		ip, userAgent := collectClientInfo(r)
+	revoked, err := s.SDB.RevokeToken(ctx, sessionID)
+	if err != nil {
+		s.writeStoreError(w, "TokensSessions, error revoking session", err)
+		return
+	}
+	s.verifyCache.Invalidate(sessionID)
 
-		// Build full URL (path + query)
-		fullURL := r.URL.Path
-		if r.URL.RawQuery != "" {
-			fullURL += "?" + r.URL.RawQuery
+	clientIP, userAgent := collectClientInfo(r)
+	if err := s.SDB.CreateTokenUsage(ctx, sessionID, time.Now().Unix(), clientIP, userAgent, r.Method, http.StatusOK); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("TokensSessions, error recording token usage: %v", err)
 		}
+	}
+	s.audit(r, AuditTokenRevoked, subject, sessionID, "session revoked by its subject")
 
-		// Log with all information
-		log.Printf("%s %s %s user_agent=%s\n", ip, r.Method, fullURL, userAgent)
-	})
+	if err := writeJSON(w, r, http.StatusOK, revoked); err != nil {
+		log.Printf("TokensSessions, error encoding response: %v", err)
+	}
 }
 
-// parseJWTToken parses JWT token string and returns token, claims, and jti
-func (s *Server) parseJWTToken(tokenString string) (*jwt.Token, jwt.MapClaims, string, error) {
-	if tokenString == "" {
-		return nil, nil, "", fmt.Errorf("empty token string")
+// exportSignature signs export bytes with a key derived from the JWT secret,
+// so an export can never be passed off as a token signature or the other way round
+func exportSignature(secret, export []byte) string {
+	keyMac := hmac.New(sha256.New, secret)
+	keyMac.Write([]byte("subject-export"))
+
+	mac := hmac.New(sha256.New, keyMac.Sum(nil))
+	mac.Write(export)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TokensExport serves the bearer's subject a signed, downloadable export of its token history.
+// Only the subject of the presented token is exported.
+func (s *Server) TokensExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// Parse JWT token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return s.JWTSecret, nil
-	})
+	tokenString := s.requestToken(r)
+	if tokenString == "" {
+		http.Error(w, "Missing token parameter", http.StatusBadRequest)
+		return
+	}
 
+	_, claims, jti, err := s.parseJWTToken(tokenString)
+	if err == nil {
+		err = s.checkDPoP(r, tokenString, claims)
+	}
 	if err != nil {
-		return nil, nil, "", err
+		s.rejectToken(w, r, err)
+		return
 	}
 
-	if !token.Valid {
-		return nil, nil, "", fmt.Errorf("invalid token")
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.lookupActiveToken(ctx, jti); err != nil {
+		if isTokenRejection(err) {
+			s.rejectToken(w, r, err)
+			return
+		}
+		s.writeStoreError(w, "TokensExport, error querying token", err)
+		return
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, nil, "", fmt.Errorf("invalid token claims")
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		http.Error(w, "Token has no subject", http.StatusForbidden)
+		return
 	}
 
-	jti, ok := claims["jti"].(string)
-	if !ok {
-		return nil, nil, "", fmt.Errorf("missing jti in token claims")
+	export := SubjectExport{Subject: subject, GeneratedAt: time.Now().UTC(), Tokens: []Token{}, Usages: []TokenUsage{}}
+	tokens, err := s.SDB.ListTokens(ctx, TokenFilter{Subject: subject})
+	if err != nil {
+		s.writeStoreError(w, "TokensExport, error querying tokens", err)
+		return
+	}
+	for _, t := range tokens {
+		usages, err := s.SDB.ListTokenUsage(ctx, t.ID)
+		if err != nil {
+			s.writeStoreError(w, "TokensExport, error querying usages", err)
+			return
+		}
+		export.Tokens = append(export.Tokens, t)
+		export.Usages = append(export.Usages, usages...)
+	}
+
+	secret, err := s.Config().JWTSecret.Secret()
+	if err != nil {
+		s.writeInternalError(w, "TokensExport, error loading JWT secret", err)
+		return
+	}
+	raw, err := json.Marshal(export)
+	if err != nil {
+		s.writeInternalError(w, "TokensExport, error encoding export", err)
+		return
 	}
+	s.audit(r, AuditDataExport, subject, jti, "")
 
-	return token, claims, jti, nil
+	w.Header().Set("Content-Disposition", `attachment; filename="token-history.json"`)
+	if err := writeJSON(w, r, http.StatusOK, SignedExport{Export: raw, Alg: "HS256", Signature: exportSignature(secret, raw)}); err != nil {
+		log.Printf("TokensExport, error encoding response: %v", err)
+	}
 }
 
-// parseJWTTokenUnverified CVE-2025-30204
-func (s *Server) parseJWTTokenUnverified(tokenString string) (*jwt.Token, jwt.MapClaims, string, error) {
-	if tokenString == "" {
-		return nil, nil, "", fmt.Errorf("empty token string")
+// TokensExportVerify checks a file downloaded from /tokens/export, answering {"valid": bool}.
+// Exports signed before a JWT secret rotation no longer verify.
+func (s *Server) TokensExportVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// Parse JWT token without verification
-	claims := jwt.MapClaims{}
-	parser := &jwt.Parser{}
-	token, _, err := parser.ParseUnverified(tokenString, claims)
+	var signed SignedExport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxExportBodyBytes)).Decode(&signed); err != nil {
+		http.Error(w, "Invalid JSON body: "+describeJSONError(err), http.StatusBadRequest)
+		return
+	}
 
+	secret, err := s.Config().JWTSecret.Secret()
 	if err != nil {
-		return nil, nil, "", err
+		s.writeInternalError(w, "TokensExportVerify, error loading JWT secret", err)
+		return
 	}
+	valid := signed.Alg == "HS256" && hmac.Equal([]byte(signed.Signature), []byte(exportSignature(secret, signed.Export)))
 
-	// ParseUnverified doesn't set token.Valid, so we use the claims directly
-	// claims is already populated by ParseUnverified
-
-	jti, ok := claims["jti"].(string)
-	if !ok {
-		return nil, nil, "", fmt.Errorf("missing jti in token claims")
+	if err := writeJSON(w, r, http.StatusOK, map[string]bool{"valid": valid}); err != nil {
+		log.Printf("TokensExportVerify, error encoding response: %v", err)
 	}
-
-	return token, claims, jti, nil
-}
-
-// Ping handles the ping-pong endpoint
-func (s *Server) Ping(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("pong"))
 }
 
-// Version handles the version endpoint and returns the JWT library version
-func (s *Server) Version(w http.ResponseWriter, r *http.Request) {
+// TokensTTL reports how long the bearer token has left, for clients deciding when to refresh.
+// An expired but otherwise genuine token is not an error, it reports expired with a 0 TTL.
+func (s *Server) TokensTTL(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Read build info to get module versions
-	buildInfo, ok := debug.ReadBuildInfo()
-	if !ok {
-		http.Error(w, "Failed to read build info", http.StatusInternalServerError)
+	tokenString := s.requestToken(r)
+	if tokenString == "" {
+		http.Error(w, "Missing token parameter", http.StatusBadRequest)
 		return
 	}
 
-	// Find the jwt/v4 module in dependencies
-	jwtVersion := "unknown"
-	for _, dep := range buildInfo.Deps {
-		if dep.Path == "github.com/golang-jwt/jwt/v4" {
-			jwtVersion = dep.Version
-			break
+	var ttl TokenTTL
+	_, claims, jti, err := s.parseJWTToken(tokenString)
+	if err == nil {
+		err = s.checkDPoP(r, tokenString, claims)
+	}
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		// Signature was verified before the time claims, so the expiry is trustworthy
+		ttl.Expired = true
+	case err != nil:
+		s.rejectToken(w, r, err)
+		return
+	default:
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		// A revoked token still has its TTL reported, an idle or tampered one is rejected
+		_, err := s.lookupActiveToken(ctx, jti)
+		switch {
+		case errors.Is(err, ErrTokenRevoked):
+			ttl.Revoked = true
+		case isTokenRejection(err):
+			s.rejectToken(w, r, err)
+			return
+		case err != nil:
+			s.writeStoreError(w, "TokensTTL, error querying token", err)
+			return
+		}
+
+		if exp, err := claimInt64(claims, "exp"); err == nil {
+			ttl.TTLSec = max(0, exp-time.Now().Unix())
 		}
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "%s\n", jwtVersion)
+	if err := writeJSON(w, r, http.StatusOK, ttl); err != nil {
+		log.Printf("TokensTTL, error encoding response: %v", err)
+	}
 }
 
-// Tokens returns list of tokens from database
-func (s *Server) Tokens(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// TokensReissue renews the bearer token in place: the same claims and jti, re-signed with the
+// current key and a later exp, for integrations keyed on a stable token identity. The token's
+// lifetime since issuance stays within ABSOLUTE_MAX_EXPIRY_SEC, clamped or rejected as at signup.
+// Like a sliding renewal, the previous token string stays valid until its own exp. One-time
+// tokens aren't reissued: their nonce is only remembered until the original exp, after which
+// a reissued copy would verify again.
+func (s *Server) TokensReissue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	tokens, err := s.SDB.ListTokens(r.Context())
-	if err != nil {
-		log.Printf("Tokens, error: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	tokenString := s.requestToken(r)
+	if tokenString == "" {
+		http.Error(w, "Missing token parameter", http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(tokens); err != nil {
-		log.Printf("Tokens, error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	parsed, claims, jti, err := s.parseJWTToken(tokenString)
+	if err == nil {
+		err = s.checkDPoP(r, tokenString, claims)
+	}
+	if err != nil {
+		s.rejectToken(w, r, err)
 		return
 	}
-}
-
-// TokensAuth creates a new JWT token and stores it in the database (imitation of sign-up/login)
-func (s *Server) TokensAuth(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if _, ok := claims["sliding"]; ok {
+		http.Error(w, "Sliding tokens are renewed on use, not reissued", http.StatusBadRequest)
+		return
+	}
+	if _, ok := claims["nonce"]; ok {
+		http.Error(w, "One-time tokens can't be reissued", http.StatusBadRequest)
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Failed to parse the form", http.StatusBadGateway)
+	// The body is optional, an empty one reissues for the default 24 hours
+	var req ReissueRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSignUpBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON body: "+describeJSONError(err), http.StatusBadRequest)
+		return
+	}
+	expSec := int64(24 * time.Hour / time.Second)
+	if req.ExpiresSec != nil {
+		expSec = *req.ExpiresSec
+	}
+	if expSec <= 0 {
+		http.Error(w, "Invalid expires_sec parameter", http.StatusBadRequest)
 		return
 	}
 
-	expSecStr := r.FormValue("expires_sec")
-	expDuration := 24 * time.Hour // default 24 hours
-	if expSecStr != "" {
-		if expSec, err := strconv.ParseInt(expSecStr, 10, 64); err == nil {
-			expDuration = time.Duration(expSec) * time.Second
-		} else {
-			http.Error(w, "Invalid expires_sec parameter", http.StatusBadRequest)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	dbToken, err := s.lookupActiveToken(ctx, jti)
+	if err != nil {
+		if isTokenRejection(err) {
+			s.rejectToken(w, r, err)
 			return
 		}
+		s.writeStoreError(w, "TokensReissue, error querying token", err)
+		return
 	}
 
-	// Setup token
+	// Compared in seconds like at signup, so huge values can't overflow time.Duration
+	cfg := s.Config()
 	now := time.Now()
-	expiresAt := now.Add(expDuration)
-	tokenID := uuid.New()
-
-	// Create JWT claims
-	claims := jwt.MapClaims{
-		"jti": tokenID,          // JWT ID
-		"iat": now.Unix(),       // Issued at
-		"exp": expiresAt.Unix(), // Expiration time
-		"nbf": now.Unix(),       // Not before
+	expiresUnix := now.Unix() + min(expSec, math.MaxInt64/2)
+	if maxSec := int64(cfg.MaxExpiry / time.Second); cfg.MaxExpiry > 0 && expiresUnix-dbToken.IssuedAt.Unix() > maxSec {
+		if cfg.MaxExpiryPolicy == MaxExpiryPolicyReject {
+			http.Error(w, "expires_sec exceeds the maximum allowed token lifetime", http.StatusBadRequest)
+			return
+		}
+		expiresUnix = dbToken.IssuedAt.Unix() + maxSec
 	}
+	if expiresUnix <= dbToken.ExpiresAt.Unix() {
+		http.Error(w, "Token can't be extended further", http.StatusConflict)
+		return
+	}
+	expiresAt := time.Unix(expiresUnix, 0)
 
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign token with secret
-	tokenString, err := token.SignedString(s.JWTSecret)
+	// Signed before the expiry moves, like renewSliding, so a failure leaves the token as it was
+	reissued := maps.Clone(claims)
+	reissued["exp"] = expiresUnix
+	tenant, _ := parsed.Header["kid"].(string)
+	reissuedString, err := signToken(cfg, reissued, tenant)
 	if err != nil {
-		log.Printf("SignUp, error signing token: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		s.writeInternalError(w, "TokensReissue, error signing token", err)
 		return
 	}
-
-	// Collect client info for replay analysis
-	clientIP, userAgent := collectClientInfo(r)
-
-	t := Token{
-		ID:        tokenID.String(),
-		IsRevoked: false,
-		IssuedAt:  now,
-		ExpiresAt: expiresAt,
-		UpdatedAt: now,
-		ClientIP:  clientIP,
-		UserAgent: userAgent,
-
-		Token: tokenString,
+	if cfg.MaxTokenBytes > 0 && len(reissuedString) > cfg.MaxTokenBytes {
+		http.Error(w, fmt.Sprintf("Token of %d bytes exceeds the %d byte limit", len(reissuedString), cfg.MaxTokenBytes), http.StatusBadRequest)
+		return
 	}
 
-	// Store token in database
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-
-	if err := s.SDB.CreateToken(ctx, t); err != nil {
-		log.Printf("SignUp, error storing token: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	// Conditioned on the stored expiry, so of concurrent reissues only one succeeds
+	extended, err := s.SDB.ExtendTokenExpiry(ctx, *dbToken, dbToken.ExpiresAt, expiresAt)
+	if err != nil {
+		s.writeStoreError(w, "TokensReissue, error extending token", err)
+		return
+	}
+	if !extended {
+		http.Error(w, "Token was changed concurrently, retry", http.StatusConflict)
 		return
 	}
+	s.verifyCache.Invalidate(jti)
+	s.audit(r, AuditTokenUpdated, dbToken.Subject, jti, "reissued until "+expiresAt.UTC().Format(time.RFC3339))
+
+	if cfg.CookieName != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cfg.CookieName,
+			Value:    reissuedString,
+			Path:     cfg.CookiePath,
+			Domain:   cfg.CookieDomain,
+			Expires:  expiresAt,
+			Secure:   cfg.CookieSecure,
+			HttpOnly: true,
+			SameSite: cfg.CookieSameSite,
+		})
+	}
 
-	// Record token usage (creation)
-	if err := s.SDB.CreateTokenUsage(ctx, t.ID, now.Unix(), clientIP, r.UserAgent(), r.Method, http.StatusCreated); err != nil {
-		log.Printf("TokensAuth, error recording token usage: %v", err)
+	tokenType := "Bearer"
+	if cnf, _ := claims["cnf"].(map[string]interface{}); cnf["jkt"] != nil {
+		tokenType = "DPoP"
+	}
+	resp := SignUpResponse{
+		Token:     reissuedString,
+		JTI:       jti,
+		TokenType: tokenType,
+		ExpiresAt: expiresAt,
+		ExpiresIn: expiresUnix - now.Unix(),
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(t); err != nil {
-		log.Printf("SignUp, error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	w.Header().Set("Cache-Control", "no-store")
+	if err := writeJSON(w, r, http.StatusOK, resp); err != nil {
+		log.Printf("TokensReissue, error encoding response: %v", err)
 	}
 }
 
-// TokensValidate checks the token valid status
-func (s *Server) TokensValidate(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// TokensUpdate patches the metadata of a token (PATCH /tokens/{id}).
+// The bearer token must be the target itself or share its subject.
+func (s *Server) TokensUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	tokenString := strings.TrimPrefix(auth, "Bearer ")
+	tokenString := s.requestToken(r)
 	if tokenString == "" {
 		http.Error(w, "Missing token parameter", http.StatusBadRequest)
 		return
 	}
 
-	// Parse and validate JWT token
-	_, _, jti, err := s.parseJWTToken(tokenString)
+	_, claims, jti, err := s.parseJWTToken(tokenString)
+	if err == nil {
+		err = s.checkDPoP(r, tokenString, claims)
+	}
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		s.rejectToken(w, r, err)
+		return
+	}
+
+	var meta TokenMeta
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSignUpBodyBytes))
+	dec.DisallowUnknownFields() // unknown includes expires_at, is_revoked, subject, ...
+	if err := dec.Decode(&meta); err != nil {
+		http.Error(w, "Invalid JSON body: "+describeJSONError(err), http.StatusBadRequest)
+		return
+	}
+	if meta.Name != nil && len(*meta.Name) > 255 {
+		http.Error(w, "Invalid name parameter", http.StatusBadRequest)
+		return
+	}
+	if !validLabels(meta.Labels) {
+		http.Error(w, "Invalid labels parameter", http.StatusBadRequest)
 		return
 	}
 
-	// Check if token is revoked in database
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	dbToken, err := s.SDB.GetTokenByID(ctx, jti)
-	if err != nil {
-		log.Printf("TokensValidate, error querying token: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if _, err := s.lookupActiveToken(ctx, jti); err != nil {
+		if isTokenRejection(err) {
+			s.rejectToken(w, r, err)
+			return
+		}
+		s.writeStoreError(w, "TokensUpdate, error querying token", err)
 		return
 	}
 
-	// If token not found in database, consider it invalid
-	if dbToken == nil {
-		http.Error(w, "Token not found", http.StatusUnauthorized)
+	// Tokens of other subjects are reported as not found to avoid leaking their existence
+	id := r.PathValue("id")
+	subject, _ := claims["sub"].(string)
+	target, err := s.SDB.GetTokenByID(ctx, id)
+	if errors.Is(err, ErrTokenNotFound) || (err == nil && id != jti && (subject == "" || target.Subject != subject)) {
+		http.Error(w, "Token not found", http.StatusNotFound)
 		return
 	}
-
-	// Collect client info for usage tracking
-	clientIP, userAgent := collectClientInfo(r)
-
-	// Check if token is revoked
-	if dbToken.IsRevoked {
-		http.Error(w, "Token revoked", http.StatusForbidden)
+	if err != nil {
+		s.writeStoreError(w, "TokensUpdate, error querying target token", err)
 		return
 	}
 
-	// Record token usage
-	now := time.Now()
-	if err := s.SDB.CreateTokenUsage(ctx, jti, now.Unix(), clientIP, userAgent, r.Method, http.StatusOK); err != nil {
-		log.Printf("TokensValidate, error recording token usage: %v", err)
-		// Don't fail the request if usage recording fails, just log it
+	if err := s.SDB.UpdateTokenMeta(ctx, id, meta); err != nil {
+		s.writeStoreError(w, "TokensUpdate, error updating token", err)
+		return
 	}
+	s.verifyCache.Invalidate(id)
+	s.audit(r, AuditTokenUpdated, subject, id, "")
 
-	// Token is valid and not revoked, return full token
-	dbToken.Token = tokenString
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(dbToken); err != nil {
-		log.Printf("TokensValidate, error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	updated, err := s.SDB.GetTokenByID(ctx, id)
+	if err != nil {
+		s.writeStoreError(w, "TokensUpdate, error querying updated token", err)
 		return
 	}
+
+	if err := writeJSON(w, r, http.StatusOK, updated); err != nil {
+		log.Printf("TokensUpdate, error encoding response: %v", err)
+	}
 }
 
-// TokensValidateUnverified CVE-2025-30204
-func (s *Server) TokensValidateUnverified(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// TokensRevoke invalidates the token
+func (s *Server) TokensRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	tokenString := strings.TrimPrefix(auth, "Bearer ")
+	// Get token from query parameter
+	tokenString := r.URL.Query().Get("token")
 	if tokenString == "" {
 		http.Error(w, "Missing token parameter", http.StatusBadRequest)
 		return
 	}
 
-	// Parse and validate JWT token
-	_, _, jti, err := s.parseJWTTokenUnverified(tokenString)
+	// Parse JWT token to extract jti, revocation is open to blocked subjects too
+	_, claims, tokenID, err := s.verifyJWTToken(tokenString)
+	if err == nil {
+		err = s.checkDPoP(r, tokenString, claims)
+	}
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		writeTokenParseError(w, err)
 		return
 	}
 
-	// Check if token is revoked in database
+	// Revoke token in database
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	dbToken, err := s.SDB.GetTokenByID(ctx, jti)
+	token, err := s.SDB.RevokeToken(ctx, tokenID)
 	if err != nil {
-		log.Printf("TokensValidate, error querying token: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	// If token not found in database, consider it invalid
-	if dbToken == nil {
-		http.Error(w, "Token not found", http.StatusUnauthorized)
+		if errors.Is(err, ErrTokenNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		s.writeStoreError(w, "TokensRevoke, error revoking token", err)
 		return
 	}
+	s.verifyCache.Invalidate(tokenID)
 
 	// Collect client info for usage tracking
 	clientIP, userAgent := collectClientInfo(r)
 
-	// Check if token is revoked
-	if dbToken.IsRevoked {
-		http.Error(w, "Token revoked", http.StatusForbidden)
-		return
-	}
-
 	// Record token usage
 	now := time.Now()
-	if err := s.SDB.CreateTokenUsage(ctx, jti, now.Unix(), clientIP, userAgent, r.Method, http.StatusOK); err != nil {
-		log.Printf("TokensValidate, error recording token usage: %v", err)
+	if err := s.SDB.CreateTokenUsage(ctx, tokenID, now.Unix(), clientIP, userAgent, r.Method, http.StatusOK); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("TokensRevoke, error recording token usage: %v", err)
+		}
 		// Don't fail the request if usage recording fails, just log it
 	}
+	s.audit(r, AuditTokenRevoked, token.Subject, tokenID, "")
+
+	// Return the revoked token
+	if err := writeJSON(w, r, http.StatusOK, token); err != nil {
+		log.Printf("TokensRevoke, error encoding response: %v", err)
+		return
+	}
+}
+
+// --- PROXY PROTOCOL ---
+
+// proxyProtoSigV2 starts every PROXY protocol v2 header
+var proxyProtoSigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener requires a PROXY protocol v1 or v2 header (HAProxy, AWS NLB) on every
+// connection and reports the client address it carries as RemoteAddr, so collectClientInfo sees
+// the client rather than the L4 proxy. A connection without a valid header is logged and closed
+// unanswered. Only enable it behind such a proxy: anyone else could spoof it.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn reads the header on first use, which happens in the connection's goroutine,
+// so a slow peer doesn't hold up Accept
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(DefaultProxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			log.Printf("proxyProtoConn, bad PROXY protocol header from %s: %v", c.Conn.RemoteAddr(), c.err)
+			// net/http answers other read errors with a 400, a failed read closes quietly
+			c.err = &net.OpError{Op: "read", Net: "tcp", Source: c.Conn.LocalAddr(), Addr: c.Conn.RemoteAddr(), Err: c.err}
+			c.Conn.Close()
+		}
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyHeader consumes a PROXY protocol header and returns the source address it carries,
+// nil for LOCAL (health check) and UNKNOWN connections, which keep the proxy's address
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, err := r.Peek(len(proxyProtoSigV2)); err == nil && bytes.Equal(sig, proxyProtoSigV2) {
+		return readProxyHeaderV2(r)
+	}
+
+	// v1 is one text line of at most 107 bytes: PROXY TCP4 <src> <dst> <sport> <dport>\r\n
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("missing header: %w", err)
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("missing header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("missing header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed v1 header")
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("malformed v1 source address")
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported v1 protocol %q", fields[1])
+	}
+}
+
+// readProxyHeaderV2 consumes a binary v2 header, whose 12-byte signature readProxyHeader has seen
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("short v2 header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]>>4
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("short v2 header: %w", err)
+	}
+
+	switch {
+	case command == 0x0: // LOCAL, sent by the proxy itself
+		return nil, nil
+	case command != 0x1:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	case family == 0x1 && len(payload) >= 12: // AF_INET: src, dst, sport, dport
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case family == 0x2 && len(payload) >= 36: // AF_INET6
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	case family == 0x1 || family == 0x2:
+		return nil, fmt.Errorf("short v2 address block")
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil
+	}
+}
+
+// --- GRACEFUL RESTART ---
+
+// Environment of a process started by gracefulRestart, each names an inherited file descriptor
+const (
+	envListenerFD = "GRACEFUL_LISTENER_FD"
+	envAdminFD    = "GRACEFUL_ADMIN_FD"
+	envReadyFD    = "GRACEFUL_READY_FD"
+)
+
+// How long gracefulRestart waits for the new process to start serving before giving up on it
+const DefaultRestartTimeout = 30 * time.Second
+
+// listen returns the listener inherited from the previous process when the envFD variable names one,
+// otherwise it listens on addr
+func listen(envFD, addr string) (net.Listener, error) {
+	fdStr := os.Getenv(envFD)
+	if fdStr == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", envFD, fdStr)
+	}
+	f := os.NewFile(uintptr(fd), addr)
+	defer f.Close() // FileListener holds its own duplicate
+	return net.FileListener(f)
+}
+
+// setListenBacklog changes the accept queue length of a listening socket. net.Listen always asks
+// for the system maximum; Linux accepts a second listen(2) on a listening socket to resize the queue.
+func setListenBacklog(ln net.Listener, backlog int) error {
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("setListenBacklog: %T is not a TCP listener", ln)
+	}
+	rc, err := tcpLn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("setListenBacklog: %w", err)
+	}
+	var listenErr error
+	if err := rc.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return fmt.Errorf("setListenBacklog: %w", err)
+	}
+	if listenErr != nil {
+		return fmt.Errorf("setListenBacklog: listen: %w", listenErr)
+	}
+	return nil
+}
 
-	// Token is valid and not revoked, return full token
-	dbToken.Token = tokenString
+// keepAliveListener applies TCP_KEEPALIVE_SEC to accepted connections. It also covers a listener
+// inherited on graceful restart, which net.ListenConfig.KeepAlive could not.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration // negative disables keep-alive probes
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(dbToken); err != nil {
-		log.Printf("TokensValidate, error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		cfg := net.KeepAliveConfig{Enable: l.period > 0, Idle: l.period, Interval: l.period}
+		if err := tcpConn.SetKeepAliveConfig(cfg); err != nil {
+			log.Printf("keepAliveListener, error setting keep-alive on %s: %v", conn.RemoteAddr(), err)
+		}
 	}
+	return conn, nil
 }
 
-// TokensUsage returns usage of exact token
-func (s *Server) TokensUsage(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// signalReady tells the process that started this one that its listeners are served
+func signalReady() {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
 		return
 	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	f.Write([]byte{1})
+}
 
-	tokenParam := r.URL.Query().Get("token")
-	if tokenParam == "" {
-		http.Error(w, "Missing token parameter", http.StatusBadRequest)
-		return
+// gracefulRestart starts a new process from the same binary and arguments that inherits the
+// listening sockets, and returns once it is serving. The kernel keeps queueing connections on the
+// shared sockets, so none are refused while this process drains.
+// Unix only. The new process gets a new PID and is reparented once this one exits, so it needs a
+// supervisor that doesn't track the original PID; not usable as PID 1 of a container.
+func gracefulRestart(ln, adminLn net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("gracefulRestart: %w", err)
 	}
 
-	_, _, tokenID, err := s.parseJWTToken(tokenParam)
+	readyR, readyW, err := os.Pipe()
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
+		return fmt.Errorf("gracefulRestart: %w", err)
 	}
+	defer readyR.Close()
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	// Drop descriptors inherited by this process, then number the new ones after stdio
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GRACEFUL_") {
+			env = append(env, kv)
+		}
+	}
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	inherit := func(envFD string, f *os.File) {
+		env = append(env, fmt.Sprintf("%s=%d", envFD, len(files)))
+		files = append(files, f)
+	}
 
-	usages, err := s.SDB.ListTokenUsage(ctx, tokenID)
+	for envFD, l := range map[string]net.Listener{envListenerFD: ln, envAdminFD: adminLn} {
+		if l == nil {
+			continue
+		}
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("gracefulRestart: %T can't be inherited", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("gracefulRestart: %w", err)
+		}
+		defer f.Close()
+		inherit(envFD, f)
+	}
+	inherit(envReadyFD, readyW)
+
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+	readyW.Close() // only the child holds the write end now, so a crash reads as EOF
 	if err != nil {
-		log.Printf("TokensUsage, error querying usages: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("gracefulRestart: %w", err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(usages); err != nil {
-		log.Printf("TokensUsage, error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			proc.Kill()
+			return fmt.Errorf("gracefulRestart: new process exited before serving: %w", err)
+		}
+	case <-time.After(DefaultRestartTimeout):
+		proc.Kill()
+		return fmt.Errorf("gracefulRestart: new process not serving after %s", DefaultRestartTimeout)
 	}
+
+	log.Printf("Graceful restart, started pid %d", proc.Pid)
+	return proc.Release()
 }
 
-// TokensRevoke invalidates the token
-func (s *Server) TokensRevoke(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// handle registers a route, or NotFound in its place if ENABLED_ENDPOINTS/DISABLED_ENDPOINTS turned it off,
+// so a disabled fixed route like /tokens/validate doesn't fall through to /tokens/{id}
+func (s *Server) handle(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	if s.Config().DisabledEndpoints[pattern] {
+		handler = s.NotFound
 	}
+	mux.HandleFunc(pattern, handler)
+}
 
-	// Get token from query parameter
-	tokenString := r.URL.Query().Get("token")
-	if tokenString == "" {
-		http.Error(w, "Missing token parameter", http.StatusBadRequest)
-		return
-	}
+// Handler returns the public routes wrapped in the middleware chain
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
 
-	// Parse JWT token to extract jti
-	_, _, tokenID, err := s.parseJWTToken(tokenString)
-	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
+	// Register routes
+	s.handle(mux, "/{$}", s.Root)
+	s.handle(mux, "/ping", s.Ping)
+	s.handle(mux, "/healthz", s.Healthz)
+	s.handle(mux, "/version", s.Version)
+	s.handle(mux, "/tokens", s.Tokens)
+	s.handle(mux, "/tokens/auth", s.TokensAuth)
+	s.handle(mux, "/tokens/auth/challenge", s.TokensAuthChallenge)
+	s.handle(mux, "/tokens/validate", s.TokensValidate)
+	s.handle(mux, "/tokens/validate/batch", s.TokensValidateBatch)
+	s.handle(mux, "/tokens/validate_unverified", s.TokensValidateUnverified)
+	s.handle(mux, "/tokens/usage", s.TokensUsage)
+	s.handle(mux, "/tokens/revoke", s.TokensRevoke)
+	s.handle(mux, "/tokens/sessions", s.TokensSessions)
+	s.handle(mux, "/tokens/ttl", s.TokensTTL)
+	s.handle(mux, "/tokens/reissue", s.TokensReissue)
+	s.handle(mux, "/tokens/export", s.TokensExport)
+	s.handle(mux, "/tokens/export/verify", s.TokensExportVerify)
+	s.handle(mux, "/tokens/{id}", s.TokensUpdate) // fixed /tokens/... routes above take precedence
+	s.handle(mux, "/revocations", s.Revocations)
+
+	// Catch-all for unknown routes, more specific patterns above take precedence
+	mux.HandleFunc("/", s.NotFound)
+
+	return s.middleware(mux)
+}
 
-	// Revoke token in database
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+// middleware wraps the public routes in the middleware chain, innermost first.
+// The concurrency slot is taken inside the timeout: a timed out handler keeps running
+// until it notices its cancelled context, and keeps holding its slot until then.
+func (s *Server) middleware(next http.Handler) http.Handler {
+	handler := s.concurrencyMiddleware(next)
+	handler = s.timeoutMiddleware(handler)
+	handler = s.maintenanceMiddleware(handler)
+	handler = s.timingMiddleware(handler)
+	handler = s.corsMiddleware(handler)
+	handler = s.securityHeadersMiddleware(handler)
+	handler = s.logMiddleware(handler)
+	handler = s.panicMiddleware(handler)
+	return handler
+}
 
-	token, err := s.SDB.RevokeToken(ctx, tokenID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Token not found", http.StatusNotFound)
+// adminAuthMiddleware admits only requests bearing ADMIN_TOKEN, refusing all of them when it is unset
+func (s *Server) adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := s.Config().AdminToken
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || adminToken == nil || !hmac.Equal([]byte(token), adminToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Admin authentication required", http.StatusUnauthorized)
 			return
 		}
-		log.Printf("TokensRevoke, error revoking token: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	// Collect client info for usage tracking
-	clientIP, userAgent := collectClientInfo(r)
+// AdminHandler returns the profiling and maintenance routes of the PPROF_ADDR listener, behind ADMIN_TOKEN
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	s.handle(mux, "/debug/pprof/", pprof.Index)
+	s.handle(mux, "/debug/pprof/cmdline", pprof.Cmdline)
+	s.handle(mux, "/debug/pprof/profile", pprof.Profile)
+	s.handle(mux, "/debug/pprof/symbol", pprof.Symbol)
+	s.handle(mux, "/debug/pprof/trace", pprof.Trace)
+	s.handle(mux, "/admin/vacuum", s.AdminVacuum)
+	s.handle(mux, "/admin/issuance", s.AdminIssuance)
+	s.handle(mux, "/admin/issuance/histogram", s.AdminIssuanceHistogram)
+	s.handle(mux, "/admin/usage", s.AdminUsage)
+	s.handle(mux, "/admin/integrity", s.AdminIntegrity)
+	s.handle(mux, "/admin/revoke", s.AdminRevoke)
+	s.handle(mux, "/admin/backup", s.AdminBackup)
+	return s.adminAuthMiddleware(mux)
+}
 
-	// Record token usage
-	now := time.Now()
-	if err := s.SDB.CreateTokenUsage(ctx, tokenID, now.Unix(), clientIP, userAgent, r.Method, http.StatusOK); err != nil {
-		log.Printf("TokensRevoke, error recording token usage: %v", err)
-		// Don't fail the request if usage recording fails, just log it
+// configureProtocols applies H2C and HTTP_KEEPALIVES to the public server.
+// The listener is plain TCP, TLS (and with it negotiated HTTP/2) is expected to end at a proxy.
+// H2C=1 additionally accepts HTTP/2 with prior knowledge, e.g. from gRPC-gateway style clients.
+// HTTP_KEEPALIVES=0 closes each connection after its response, spreading clients across
+// replicas behind an L4 balancer at the cost of a TCP handshake per request
+func configureProtocols(hs *http.Server, cfg *Config) {
+	hs.SetKeepAlivesEnabled(cfg.HTTPKeepAlives)
+
+	if cfg.H2C {
+		hs.Protocols = new(http.Protocols)
+		hs.Protocols.SetHTTP1(true)
+		hs.Protocols.SetUnencryptedHTTP2(true)
 	}
+}
 
-	// Return the revoked token
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(token); err != nil {
-		log.Printf("TokensRevoke, error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+// serveListener wraps the public listener in TCP_KEEPALIVE_SEC and PROXY_PROTOCOL handling.
+// Keep-alive needs the TCP connection, so it goes inside the PROXY protocol wrapper.
+func serveListener(ln net.Listener, cfg *Config) net.Listener {
+	if cfg.TCPKeepAlive != 0 {
+		ln = keepAliveListener{Listener: ln, period: cfg.TCPKeepAlive}
 	}
+	if cfg.ProxyProtocol {
+		ln = proxyProtoListener{ln}
+	}
+	return ln
 }
 
 // --- MAIN ENTRYPOINT ---
 
 func main() {
-	dbUri := os.Getenv("DATABASE_URI")
-	if dbUri == "" {
-		dbUri = DefaultDatabaseSqliteURI
-	}
+	// Tokens and secrets never reach the logs, all output below goes through log
+	log.SetOutput(logRedactor.Writer(os.Stderr))
 
-	serverAddr := os.Getenv("SERVER_ADDR")
-	if serverAddr == "" {
-		serverAddr = DefaultServerAddr
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Printf("Failed to load config, error: %v", err)
+		os.Exit(1)
 	}
-
-	serverPort := os.Getenv("SERVER_PORT")
-	if serverPort == "" {
-		serverPort = DefaultServerPort
-	} else {
-		if _, err := strconv.Atoi(serverPort); err != nil {
-			fmt.Printf("Invalid port: %s, must be a number", serverPort)
-			os.Exit(1)
+	logRedactor.SetSecrets(cfg)
+
+	// Initialize database connection using registry. A file locked by another process is waited for:
+	// switching to WAL and the first write would otherwise fail with a bare "database is locked".
+	log.Println("Initializing database connection")
+	var database *SqliteDB
+	err = retryWhileLocked(sqliteFilePath(cfg.DatabaseURI), cfg.DatabaseLockWait, func() error {
+		db, err := NewSqliteDB(cfg.DatabaseURI, true, "NORMAL", cfg.DatabaseReadConns)
+		if err != nil {
+			return err
 		}
-	}
-
-	// Initialize database connection using registry
-	fmt.Println("Initializing database connection")
-	database, err := NewSqliteDB(dbUri, true, "NORMAL")
+		if err := db.ProbeWriteLock(context.Background()); err != nil {
+			db.Close()
+			return err
+		}
+		database = db
+		return nil
+	})
 	if err != nil {
-		fmt.Printf("Failed to initialize database connection, error: %v", err)
+		log.Printf("Failed to initialize database connection, error: %v", err)
 		os.Exit(1)
 	}
+	database.breaker = newCircuitBreaker(cfg.DBBreakerThreshold, cfg.DBBreakerCooldown)
+	database.claimColumns = cfg.ClaimColumns
+	database.rowKey = cfg.RowHMACKey
 
 	// Test database connection
 	if err := database.TestConnection(context.Background()); err != nil {
-		fmt.Printf("Failed to test database connection, error: %v", err)
+		log.Printf("Failed to test database connection, error: %v", err)
 		os.Exit(1)
 	}
-	fmt.Println("Database connection established successfully")
+	log.Println("Database connection established successfully")
+
+	if cfg.DatabaseAutoMigrate {
+		if err := database.RunMigrations(context.Background()); err != nil {
+			log.Printf("Failed to run database migrations, error: %v", err)
+			os.Exit(1)
+		}
+		log.Println("Database migrations applied")
+	}
 
-	if err := database.RunMigrations(context.Background()); err != nil {
-		fmt.Printf("Failed to run database migrations, error: %v", err)
+	if err := database.CheckSchema(context.Background()); err != nil {
+		log.Printf("Failed to check database schema, error: %v", err)
 		os.Exit(1)
 	}
-	fmt.Println("Database migrations applied")
 
 	// Create context for graceful shutdown
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
@@ -1124,69 +8052,316 @@ func main() {
 	}
 	defer debugStop()
 
-	// Get JWT secret from environment or use default
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		fmt.Println("Set default JWT secret")
-		jwtSecret = DefaultJWTSecret
+	audit, err := NewAuditLogger(cfg.AuditLogOutput)
+	if err != nil {
+		log.Printf("Failed to open audit log, error: %v", err)
+		os.Exit(1)
 	}
+	defer audit.Close()
 
 	// Create HTTP server
-	server := Server{
-		SDB:       *database,
-		JWTSecret: []byte(jwtSecret),
+	server := NewServer(database, cfg)
+	server.Audit = audit
+	if cfg.ClientAccounting {
+		server.Usage = NewUsageAccountant()
 	}
 
-	mux := http.NewServeMux()
+	if cfg.SelfTest {
+		if err := server.selfTest(); err != nil {
+			log.Printf("Self-test failed, error: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Self-test passed, %s token minted and verified", cfg.JWTAlg)
+	}
 
-	// Register routes
-	mux.HandleFunc("/ping", server.Ping)
-	mux.HandleFunc("/version", server.Version)
-	mux.HandleFunc("/tokens", server.Tokens)
-	mux.HandleFunc("/tokens/auth", server.TokensAuth)
-	mux.HandleFunc("/tokens/validate", server.TokensValidate)
-	mux.HandleFunc("/tokens/validate_unverified", server.TokensValidateUnverified)
-	mux.HandleFunc("/tokens/usage", server.TokensUsage)
-	mux.HandleFunc("/tokens/revoke", server.TokensRevoke)
-
-	commonHandler := server.logMiddleware(mux)
-	commonHandler = server.panicMiddleware(commonHandler)
+	// Reload configuration on SIGHUP without dropping connections
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
 
-	s := &http.Server{
-		Addr:    fmt.Sprintf("%s:%s", serverAddr, serverPort),
-		Handler: commonHandler,
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reload:
+				if err := server.ReloadConfig(); err != nil {
+					log.Printf("Failed to reload config, error: %v", err)
+					continue
+				}
+				log.Println("Config reloaded")
+			}
+		}
+	}()
+
+	// Clock sanity check at startup and then periodically, NTP_CHECK_SERVER is re-read on every tick
+	server.checkClock(ctx)
+	go func() {
+		t := time.NewTicker(DefaultNTPCheckInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				server.checkClock(ctx)
+			}
+		}
+	}()
+
+	// Drop nonces of expired one-time tokens, and revoke tokens idle past IDLE_TIMEOUT_SEC
+	go func() {
+		t := time.NewTicker(DefaultNonceCleanupInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				cleanupCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				if n, err := server.SDB.DeleteExpiredNonces(cleanupCtx, now); err != nil {
+					log.Printf("Nonce cleanup, error: %v", err)
+				} else if n > 0 {
+					log.Printf("Nonce cleanup, removed %d expired nonces", n)
+				}
+				if idle := server.Config().IdleTimeout; idle > 0 {
+					if n, err := server.revokeIdleTokens(cleanupCtx, now, idle); err != nil {
+						log.Printf("Idle cleanup, error: %v", err)
+					} else if n > 0 {
+						log.Printf("Idle cleanup, revoked %d tokens unused for %s", n, idle)
+					}
+				}
+				cancel()
+			}
+		}
+	}()
+
+	// Forget DPoP proofs that can no longer be replayed
+	go func() {
+		t := time.NewTicker(DefaultDPoPPruneInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				server.dpop.Prune(now)
+			}
+		}
+	}()
+
+	// Forget solved challenges that can no longer be replayed
+	go func() {
+		t := time.NewTicker(DefaultPowPruneInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				server.pow.Prune(now)
+			}
+		}
+	}()
+
+	// Write per-client issuance counts in batches, off the signup path
+	if server.Usage != nil {
+		go func() {
+			t := time.NewTicker(DefaultUsageFlushInterval)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+					flushCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+					if err := server.Usage.Flush(flushCtx, &server.SDB); err != nil {
+						log.Printf("Usage flush, error: %v", err)
+					}
+					cancel()
+				}
+			}
+		}()
+	}
+
+	// Token count for MAX_TOTAL_TOKENS, the cap is re-read on every tick so SIGHUP applies
+	if cfg.MaxTotalTokens > 0 {
+		server.refreshTokenCount(ctx)
 	}
+	go func() {
+		t := time.NewTicker(DefaultTokenCountInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if server.Config().MaxTotalTokens == 0 {
+					continue
+				}
+				countCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				server.refreshTokenCount(countCtx)
+				cancel()
+			}
+		}
+	}()
 
+	// Scheduled VACUUM, interval and window are re-read on every tick so SIGHUP applies
 	go func() {
-		http.ListenAndServe("localhost:6060", nil)
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+
+		var lastRun time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				c := server.Config()
+				if c.VacuumInterval == 0 || now.Sub(lastRun) < c.VacuumInterval {
+					continue
+				}
+				if !c.inVacuumWindow(now) {
+					continue
+				}
+				lastRun = now
+
+				vacuumCtx, cancel := context.WithTimeout(ctx, DefaultVacuumTimeout)
+				if _, err := server.vacuum(vacuumCtx); err != nil {
+					log.Printf("Scheduled vacuum, error: %v", err)
+				}
+				cancel()
+			}
+		}
 	}()
 
+	// Base context of all requests, cancelled if handlers outlive the shutdown deadline
+	// so their queries are aborted and release the database connection
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	s := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", cfg.ServerAddr, cfg.ServerPort),
+		Handler: server.Handler(),
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+	}
+
+	configureProtocols(s, cfg)
+
+	// Profiling and maintenance endpoints live on a separate admin listener, off the public interface
+	var adminLn net.Listener
+	var adminSrv *http.Server
+	if cfg.PprofAddr != "" {
+		if adminLn, err = listen(envAdminFD, cfg.PprofAddr); err != nil {
+			log.Printf("Failed to listen for pprof, error: %v", err)
+			os.Exit(1)
+		}
+
+		adminSrv = &http.Server{
+			Handler: server.AdminHandler(),
+			BaseContext: func(net.Listener) context.Context {
+				return baseCtx
+			},
+		}
+
+		go func() {
+			log.Printf("Starting pprof server at %s", cfg.PprofAddr)
+			if err := adminSrv.Serve(adminLn); err != nil && err != http.ErrServerClosed {
+				log.Printf("Pprof server error, error: %v", err)
+			}
+		}()
+	}
+
+	ln, err := listen(envListenerFD, s.Addr)
+	if err != nil {
+		log.Printf("Failed to listen, error: %v", err)
+		os.Exit(1)
+	}
+
+	if cfg.ListenBacklog > 0 {
+		if err := setListenBacklog(ln, cfg.ListenBacklog); err != nil {
+			log.Printf("Failed to set listen backlog, error: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// The wrappers apply only to what is served, the raw listener is what a graceful restart hands over
+	serveLn := serveListener(ln, cfg)
+
 	// Start server in a goroutine
 	go func() {
-		fmt.Printf("Starting HTTP server at %s:%s\n", serverAddr, serverPort)
-		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			fmt.Printf("Server error, error: %v", err)
+		log.Printf("Starting HTTP server at %s:%s", cfg.ServerAddr, cfg.ServerPort)
+		if err := s.Serve(serveLn); err != nil && err != http.ErrServerClosed {
+			log.Printf("Server error, error: %v", err)
+		}
+	}()
+	signalReady()
+
+	// Graceful restart on SIGUSR2: a new process takes over the listening sockets, this one drains and exits
+	restart := make(chan os.Signal, 1)
+	signal.Notify(restart, syscall.SIGUSR2)
+	defer signal.Stop(restart)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-restart:
+				if err := gracefulRestart(ln, adminLn); err != nil {
+					log.Printf("Graceful restart failed, still serving, error: %v", err)
+					continue
+				}
+				log.Printf("Graceful restart, new process is serving, draining this one")
+				stop()
+				return
+			}
 		}
 	}()
 
 	// Wait for shutdown signal
 	<-ctx.Done()
-	fmt.Println("Received shutdown signal, starting graceful shutdown")
+	log.Println("Received shutdown signal, starting graceful shutdown")
 
 	// Create shutdown context with timeout
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// Gracefully close database connection
-	fmt.Println("Closing database connection")
-	database.Close()
-
-	// Attempt graceful shutdown of HTTP server
+	// Attempt graceful shutdown of HTTP server, draining in-flight requests
 	if err := s.Shutdown(shutdownCtx); err != nil {
-		fmt.Printf("Server shutdown error, error: %v", err)
+		log.Printf("Server shutdown error, error: %v", err)
 	} else {
-		fmt.Println("Server shutdown completed successfully")
+		log.Println("Server shutdown completed successfully")
+	}
+
+	// The admin listener drains too, a backup or vacuum in flight finishes before the database closes
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Pprof server shutdown error, error: %v", err)
+		}
+	}
+
+	// Cancel requests still running after the deadline
+	cancelRequests()
+
+	// Counts of the requests drained above
+	if err := server.Usage.Flush(shutdownCtx, &server.SDB); err != nil {
+		log.Printf("Usage flush, error: %v", err)
+	}
+
+	// Close database connection only after the HTTP server drained
+	log.Println("Closing database connection")
+	if err := database.CloseContext(shutdownCtx); err != nil {
+		log.Printf("Database force-closed, error: %v", err)
 	}
 
-	fmt.Println("Application shutdown complete")
+	log.Println("Application shutdown complete")
 }